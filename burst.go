@@ -0,0 +1,52 @@
+package tcplimit
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// minAdaptiveBurst and maxAdaptiveBurst bound the bursts computed
+	// in the adaptive mode, so that neither the I/O ops get too small
+	// nor the bursts too large for the shaping to be noticed.
+	minAdaptiveBurst = 1
+	maxAdaptiveBurst = 1024 * 1024
+)
+
+// burstPolicy decides on the limiter's burst, which is also the maximum
+// size of a single I/O operation (chunk).
+type burstPolicy struct {
+	// size is a fixed burst, used when the interval is not set.
+	size int
+	// interval is a pacing interval of the adaptive mode. The burst is
+	// sized to what the limit allows to transfer during the interval.
+	interval time.Duration
+}
+
+func (p burstPolicy) burstFor(limit rate.Limit) int {
+	if p.interval <= 0 {
+		return p.size
+	}
+
+	if limit == rate.Inf {
+		return maxAdaptiveBurst
+	}
+
+	burst := float64(limit) * p.interval.Seconds()
+	return int(min(max(burst, minAdaptiveBurst), maxAdaptiveBurst))
+}
+
+// setLimitAt sets the limiter's limit along with the burst the policy
+// decides on. As rate.Limiter consumes its burst when the limit is zero,
+// the burst is always set anew.
+func (p burstPolicy) setLimitAt(lim *rate.Limiter, t time.Time, limit rate.Limit) {
+	lim.SetLimitAt(t, limit)
+	lim.SetBurstAt(t, p.burstFor(limit))
+}
+
+func (p burstPolicy) newLimiter(limit rate.Limit) *rate.Limiter {
+	return rate.NewLimiter(limit, p.burstFor(limit))
+}
+
+var defaultBurstPolicy = burstPolicy{size: chunkSize}
@@ -0,0 +1,54 @@
+package tcplimit
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestBurstPolicy(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		policy   burstPolicy
+		limit    rate.Limit
+		expected int
+	}{
+		{
+			name:     "fixed",
+			policy:   burstPolicy{size: 4096},
+			limit:    rate.Limit(100),
+			expected: 4096,
+		},
+		{
+			name:     "adaptive",
+			policy:   burstPolicy{interval: 10 * time.Millisecond},
+			limit:    rate.Limit(100 * 1024),
+			expected: 1024,
+		},
+		{
+			name:     "adaptive lower bound",
+			policy:   burstPolicy{interval: 10 * time.Millisecond},
+			limit:    rate.Limit(0),
+			expected: minAdaptiveBurst,
+		},
+		{
+			name:     "adaptive upper bound",
+			policy:   burstPolicy{interval: 10 * time.Millisecond},
+			limit:    rate.Limit(1024 * 1024 * 1024),
+			expected: maxAdaptiveBurst,
+		},
+		{
+			name:     "adaptive unlimited",
+			policy:   burstPolicy{interval: 10 * time.Millisecond},
+			limit:    rate.Inf,
+			expected: maxAdaptiveBurst,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.policy.burstFor(test.limit); got != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package tcplimit
+
+import "golang.org/x/time/rate"
+
+// chain holds what the connections are charged against besides their own
+// limiters, ordered from the Limiter down through the groups they belong to.
+type chain struct {
+	read   []*rate.Limiter
+	write  []*rate.Limiter
+	quotas []*quota
+	usages []*fairUsage
+}
+
+// withLimiters returns the chain extended with the pair of limiters.
+func (c chain) withLimiters(read, write *rate.Limiter) chain {
+	c.read = extend(c.read, read)
+	c.write = extend(c.write, write)
+	return c
+}
+
+// withQuota returns the chain extended with the quota.
+func (c chain) withQuota(q *quota) chain {
+	c.quotas = extend(c.quotas, q)
+	return c
+}
+
+// withFairUsage returns the chain extended with the fair-usage policy,
+// along with its limiters.
+func (c chain) withFairUsage(u *fairUsage) chain {
+	c = c.withLimiters(u.read, u.write)
+	c.usages = extend(c.usages, u)
+	return c
+}
+
+// extend appends v to a copy of s, so that chains sharing a prefix
+// don't overwrite each other's elements.
+func extend[T any](s []T, v T) []T {
+	return append(s[:len(s):len(s)], v)
+}
@@ -11,6 +11,10 @@ type Clock interface {
 	// Sleep pauses the current goroutine for at least the duration d.
 	// A negative or zero duration causes Sleep to return immediately.
 	Sleep(d time.Duration)
+	// NewTimer creates a timer that sends the current time on the returned
+	// channel after at least the duration d. Calling stop prevents the timer
+	// from firing; it returns false if the timer has already fired.
+	NewTimer(d time.Duration) (c <-chan time.Time, stop func() bool)
 }
 
 var defaultClock Clock = new(timeClock) // Stateless
@@ -24,3 +28,8 @@ func (c *timeClock) Now() time.Time {
 func (c *timeClock) Sleep(d time.Duration) {
 	time.Sleep(d)
 }
+
+func (c *timeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
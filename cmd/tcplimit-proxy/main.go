@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -65,14 +66,28 @@ func handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go copyConn(dest, src)
+	done := make(chan struct{})
+	go func() {
+		copyConn(dest, src)
+		close(done)
+	}()
 	copyConn(src, dest)
+	<-done
+
+	dest.Close()
+	src.Close()
 }
 
-func copyConn(dst io.WriteCloser, src io.ReadCloser) {
+// copyConn copies until EOF, then half-closes the destination, so that
+// the other direction can still finish. Destinations not supporting
+// half-closing are closed right away.
+func copyConn(dst net.Conn, src net.Conn) {
 	io.Copy(dst, src)
-	dst.Close()
-	src.Close()
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
 }
 
 func handlePutLimit(limiter *tcplimit.Limiter) http.HandlerFunc {
@@ -104,9 +119,21 @@ func handlePutLimit(limiter *tcplimit.Limiter) http.HandlerFunc {
 		case "/limits/global":
 			limiter.SetGlobalLimit(rate.Limit(limit))
 			fmt.Println(r.RemoteAddr, "Global limit set to", limit)
+		case "/limits/global/read":
+			limiter.SetGlobalReadLimit(rate.Limit(limit))
+			fmt.Println(r.RemoteAddr, "Global read limit set to", limit)
+		case "/limits/global/write":
+			limiter.SetGlobalWriteLimit(rate.Limit(limit))
+			fmt.Println(r.RemoteAddr, "Global write limit set to", limit)
 		case "/limits/local":
 			limiter.SetLocalLimit(rate.Limit(limit))
 			fmt.Println(r.RemoteAddr, "Local limit set to", limit)
+		case "/limits/local/read":
+			limiter.SetLocalReadLimit(rate.Limit(limit))
+			fmt.Println(r.RemoteAddr, "Local read limit set to", limit)
+		case "/limits/local/write":
+			limiter.SetLocalWriteLimit(rate.Limit(limit))
+			fmt.Println(r.RemoteAddr, "Local write limit set to", limit)
 		default:
 			w.WriteHeader(http.StatusNotFound)
 		}
@@ -115,6 +142,20 @@ func handlePutLimit(limiter *tcplimit.Limiter) http.HandlerFunc {
 	}
 }
 
+func handleGetStats(limiter *tcplimit.Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(limiter.Stats()); err != nil {
+			printError(r.RemoteAddr, "Could not write response:", err)
+		}
+	}
+}
+
 func proxyHandler(limiter *tcplimit.Limiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Why not use http.ServeMux? When wget connects to our proxy,
@@ -124,6 +165,11 @@ func proxyHandler(limiter *tcplimit.Limiter) http.HandlerFunc {
 			return
 		}
 
+		if r.URL.Path == "/stats" {
+			handleGetStats(limiter).ServeHTTP(w, r)
+			return
+		}
+
 		handleConnect(w, r)
 	}
 }
@@ -1,18 +1,34 @@
 package tcplimit
 
 import (
+	"context"
 	"errors"
+	"maps"
+	"math"
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
 const (
-	chunkSize = 1024 // 1kB for now, a trade-off between the number of I/O ops and shaping accuracy.
+	// chunkSize is the default burst, and so the maximum size of a single
+	// I/O operation. 1kB for now, a trade-off between the number of I/O ops
+	// and shaping accuracy. See WithBurst and WithAdaptiveBurst.
+	chunkSize = 1024
 )
 
 var (
-	ErrInvalidLimit = errors.New("invalid limit")
+	ErrInvalidLimit  = errors.New("invalid limit")
+	ErrInvalidBurst  = errors.New("invalid burst")
+	ErrInvalidWeight = errors.New("invalid weight")
+	ErrInvalidQuota  = errors.New("invalid quota")
+	// ErrQuotaExceeded means that the connection has transferred all
+	// of the bytes its quota (or one of its groups' quotas) allows
+	// in the current period.
+	ErrQuotaExceeded = errors.New("quota exceeded")
 	// ErrUnfulfillableReservation means that the operation cannot fulfill
 	// the internal bandwidth reservation.
 	ErrUnfulfillableReservation = errors.New("unfulfillable reservation")
@@ -21,129 +37,770 @@ var (
 // Conn is a generic stream-oriented network connection, enriched
 // by the ability to set bandwidth limits.
 //
+// Read (ingress) and write (egress) traffic is shaped independently,
+// each direction having its own limit.
+//
+// Throttled operations respect read and write deadlines, failing with
+// os.ErrDeadlineExceeded when a deadline passes while waiting for
+// the bandwidth, and with net.ErrClosed when the Conn gets closed.
+// Once the Conn exceeds its quota (see Limiter.SetLocalQuota), or the quota
+// of one of its groups, the operations fail with ErrQuotaExceeded, until
+// the quota gets reset or topped up.
+//
 // Multiple goroutines may invoke methods on a Conn simultaneously.
 type Conn interface {
 	net.Conn
 
-	// SetLimitAt sets a new Limit for the limiter. To disable limiting,
-	// the Limit can be set to rate.Inf. A zero Limit allows no operations,
-	// causing them to fail with ErrUnfulfillableReservation.
+	// ReadContext acts like Read, but stops waiting for the bandwidth
+	// when the context is done, returning the context's error.
+	ReadContext(ctx context.Context, p []byte) (n int, err error)
+	// WriteContext acts like Write, but stops waiting for the bandwidth
+	// when the context is done, returning the context's error.
+	WriteContext(ctx context.Context, p []byte) (n int, err error)
+
+	// SetLimit sets a new Limit for both read and write directions.
+	// To disable limiting, the Limit can be set to rate.Inf. A zero Limit
+	// allows no operations, causing them to fail with
+	// ErrUnfulfillableReservation.
+	//
+	// The Limit overrides the local limit of the Limiter, meaning that
+	// it is no longer affected by Limiter.SetLocalLimit, until
+	// the ResetLimit is called.
 	//
 	// Returns ErrInvalidLimit when Limit is negative.
 	SetLimit(limit rate.Limit) error
-	// Limit returns the current Limit.
+	// Limit returns the current Limit. When read and write limits differ,
+	// the lower of them is returned.
 	Limit() rate.Limit
+	// SetReadLimit sets a new Limit for the read direction only.
+	// See SetLimit for more information.
+	SetReadLimit(limit rate.Limit) error
+	// ReadLimit returns the current read Limit.
+	ReadLimit() rate.Limit
+	// SetWriteLimit sets a new Limit for the write direction only.
+	// See SetLimit for more information.
+	SetWriteLimit(limit rate.Limit) error
+	// WriteLimit returns the current write Limit.
+	WriteLimit() rate.Limit
+	// ResetLimit drops the limits set by SetLimit, SetReadLimit
+	// and SetWriteLimit, so that the connection inherits the local
+	// limits of the Limiter again.
+	ResetLimit()
+	// SetBurst overrides the burst (the maximum number of bytes transferred
+	// by a single I/O operation) of the connection, for both directions.
+	// The burst is fixed from now on, even if the Limiter is in the adaptive
+	// mode. Note that the global limit's burst still takes precedence,
+	// when it is lower.
+	//
+	// Returns ErrInvalidBurst when burst is less than one.
+	SetBurst(burst int) error
+	// Burst returns the current burst. When read and write bursts differ,
+	// the lower of them is returned.
+	Burst() int
+	// SetWeight sets the connection's weight, which is its share of
+	// the global limit, relative to the other connections of the same
+	// priority. By default, the weight is one. The weight takes effect
+	// only when the Limiter shares the global limit fairly
+	// (see WithFairSharing).
+	//
+	// Returns ErrInvalidWeight when weight is not a positive number.
+	SetWeight(weight float64) error
+	// Weight returns the connection's weight.
+	Weight() float64
+	// SetPriority sets the connection's strict priority class. Connections
+	// of a lower priority get only the bandwidth left unused by the higher
+	// ones. By default, the priority is zero. The priority takes effect
+	// only when the Limiter shares the global limit fairly
+	// (see WithFairSharing).
+	SetPriority(priority int)
+	// Priority returns the connection's priority class.
+	Priority() int
+	// Stats returns the connection's traffic statistics.
+	Stats() ConnStats
+	// Unwrap returns the underlying connection. Note that its I/O
+	// is not limited.
+	Unwrap() net.Conn
+	// ID returns the connection's identifier, unique within its Limiter
+	// (see Limiter.Conn).
+	ID() uint64
+	// SetLabel sets the user-defined label of the connection, e.g. to tell
+	// its client or tenant. An empty value removes the label.
+	SetLabel(key, value string)
+	// Labels returns a copy of the connection's labels.
+	Labels() map[string]string
+}
+
+// ConnInfo describes a connection wrapped by a Limiter at a time.
+type ConnInfo struct {
+	// ID is the connection's identifier, unique within its Limiter.
+	ID         uint64
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// ReadLimit and WriteLimit are the connection's local limits.
+	ReadLimit  rate.Limit
+	WriteLimit rate.Limit
+	// Labels are the connection's user-defined labels.
+	Labels map[string]string
+	// Stats are the connection's traffic statistics, including
+	// the time of its creation.
+	Stats ConnStats
+}
+
+// buckets are the limiters charged by one direction of traffic.
+type buckets struct {
+	// shared are limiters shared between other connections, ordered from
+	// the global limiter down through the groups the connection belongs to,
+	// followed by the limiters of the connection's own policies (such
+	// as the fair usage or the credits).
+	shared []*rate.Limiter
+	// local is a private limiter owned by the connection.
+	local *rate.Limiter
+	// sched, when set, hands out the global limiter's tokens fairly
+	// between the connections. The global limiter is not a part
+	// of the shared limiters then.
+	sched *scheduler
+	// flow is the connection's flow scheduled by sched.
+	flow *flow
+	// quotas cap the number of bytes transferred, ordered like
+	// the shared limiters, the connection's own quota being last.
+	// They are shared by both directions of traffic.
+	quotas []*quota
+	// usages track the traffic for the fair-usage policies, whose
+	// limiters are a part of the shared limiters. They are shared
+	// by both directions of traffic.
+	usages []*fairUsage
+}
+
+// all returns every limiter of the buckets, the local one being last.
+func (b buckets) all() []*rate.Limiter {
+	return append(b.shared[:len(b.shared):len(b.shared)], b.local)
 }
 
 type conn struct {
 	net.Conn
 
-	// globalLimiter is a limiter shared between other connections.
-	globalLimiter *rate.Limiter
-	// localLimiter is a private limiter owned by the connection.
-	localLimiter *rate.Limiter
-	clock        Clock
-	close        func(Conn)
+	read          buckets
+	write         buckets
+	readDeadline  deadline
+	writeDeadline deadline
+	clock         Clock
+	close         func(Conn)
+	closeOnce     sync.Once
+	closed        chan struct{}
+	mu            sync.Mutex
+	burst         burstPolicy
+	weight        float64
+	priority      int
+	stats         counters
+	created       time.Time
+	// quota is the connection's own quota, if any.
+	quota *quota
+	// link, when set, delivers the written data instead
+	// of writing it directly.
+	link *link
+	// faults are the faults injected into the connection, if any.
+	faults *faults
+	// readInherited and writeInherited tell whether the local limits
+	// are inherited from the Limiter, or overridden.
+	readInherited  bool
+	writeInherited bool
+	// reset makes the connection inherit the local limits again.
+	reset func(*conn)
+	// outer is the Conn handing out the conn (see expose).
+	outer Conn
+	id    uint64
+	// labels are the user-defined labels, guarded by the mutex.
+	labels map[string]string
 }
 
-func (c *conn) do(p []byte, f func([]byte) (int, error)) (n int, err error) {
+// do performs the operation f on a chunk of p, as soon as the bandwidth
+// allows. When upfront is set, the whole chunk is reserved before
+// the operation. Otherwise, the limiters are only expected to be out
+// of debt. Either way, they end up charged for the bytes actually
+// transferred.
+func (c *conn) do(ctx context.Context, p []byte, upfront bool, b buckets,
+	dl *deadline, f func([]byte) (int, error)) (n int, err error) {
 	// The bulk of limiter logic resides here. We try to acquire reservations
-	// both from the golbal limiter first, then the second. Then take
-	// the greater wait time to fulfill one of the reservations.
-	now := c.clock.Now()
+	// from all of the limiters, starting with the global one. Then take
+	// the greatest wait time to fulfill all of the reservations.
+	limiters := b.all()
+
+	// The fair-usage tiers, if lowered, are checked first, as they may
+	// be due to get back to the regular ones.
+	for _, u := range b.usages {
+		u.check(c.clock.Now())
+	}
+
+	// A zero limit is checked upfront, as rate.Limiter would otherwise
+	// let the operations through until its burst gets exhausted. So is
+	// a zero burst of a finite limit, which no reservation can fit in.
+	for _, lim := range limiters {
+		if lim.Limit() == 0 || (lim.Limit() != rate.Inf && lim.Burst() <= 0) {
+			return 0, ErrUnfulfillableReservation
+		}
+	}
 
-	globalReservation := c.globalLimiter.ReserveN(now, len(p))
-	if !globalReservation.OK() {
-		return 0, ErrUnfulfillableReservation
+	// The chunk must not exceed any of the bursts, which may be
+	// changed concurrently along with the limits. In such case,
+	// we simply try again with a new chunk size.
+	maxChunk := func() int {
+		size := chunk(limiters)
+		if b.sched != nil && b.sched.lim.Limit() != rate.Inf {
+			size = min(size, b.sched.lim.Burst())
+		}
+		return size
 	}
+	p = p[:min(len(p), maxChunk())]
 
-	localReservation := c.localLimiter.ReserveN(now, len(p))
-	if !localReservation.OK() {
-		globalReservation.CancelAt(now)
-		return 0, ErrUnfulfillableReservation
+	if len(b.quotas) > 0 && len(p) > 0 && upfront {
+		// The quotas are taken before waiting for the bandwidth, so that
+		// concurrent operations cannot overrun them, and what was not
+		// transferred in the end is given back.
+		granted := takeQuotas(b.quotas, c.clock.Now(), len(p))
+		if granted == 0 {
+			return 0, ErrQuotaExceeded
+		}
+		p = p[:granted]
+		defer func() {
+			giveQuotas(b.quotas, c.clock.Now(), granted-n)
+		}()
+	} else if len(b.quotas) > 0 && len(p) > 0 {
+		// Otherwise, the quotas are taken after the fact, like
+		// the bandwidth, as the operation may wait for the peer
+		// indefinitely, holding them from the other operations.
+		// It is still capped to what is left.
+		left := leftQuotas(b.quotas, c.clock.Now())
+		if left == 0 {
+			return 0, ErrQuotaExceeded
+		}
+		p = p[:min(int64(len(p)), left)]
+		defer func() {
+			useQuotas(b.quotas, c.clock.Now(), n)
+		}()
 	}
 
-	c.clock.Sleep(
-		max(
-			globalReservation.DelayFrom(now),
-			localReservation.DelayFrom(now),
-		),
+	var (
+		now          time.Time
+		reserve      int
+		reservations []*rate.Reservation
+		throttled    bool
 	)
+	start := c.clock.Now()
+	for reservations == nil {
+		p = p[:min(len(p), maxChunk())]
+		if upfront {
+			reserve = len(p)
+		}
+
+		now = c.clock.Now()
+
+		reservations, err = reserveN(limiters, now, reserve)
+		if err != nil {
+			return 0, err
+		}
+
+		var delay time.Duration
+		for _, r := range reservations {
+			delay = max(delay, r.DelayFrom(now))
+		}
+		if delay > 0 {
+			throttled = true
+			if _, err = c.wait(ctx, delay, dl, nil); err != nil {
+				// Give back what we did not use, so that other
+				// connections won't be penalized by our failure.
+				cancelAt(reservations, c.clock.Now())
+				return 0, err
+			}
+		}
+
+		// With the fair sharing, the global limiter's tokens are acquired
+		// last, so that the connections wait in the queue only for what
+		// their own limits allow them to transfer.
+		if b.sched != nil {
+			err = b.sched.acquire(b.flow, reserve, len(p),
+				func(d time.Duration, wake <-chan struct{}) (err error) {
+					throttled = true
+					_, err = c.wait(ctx, d, dl, wake)
+					return
+				},
+			)
+			if err != nil {
+				// The reservations are already due, so they are
+				// given back by charging the limiters instead.
+				now = c.clock.Now()
+				for _, lim := range limiters {
+					chargeN(lim, now, -reserve)
+				}
+				if err != errBurstExceeded {
+					return 0, err
+				}
+				reservations = nil
+			}
+		}
+	}
+
+	if throttled {
+		c.stats.addThrottling(c.clock.Now().Sub(start))
+	}
 
 	n, err = f(p)
+	if n != reserve || (b.sched != nil && n != len(p)) {
+		// Operations are charged only for the bytes actually transferred,
+		// otherwise short reads (or failures) would waste the bandwidth.
+		now = c.clock.Now()
+		for _, lim := range limiters {
+			chargeN(lim, now, n-reserve)
+		}
+		if b.sched != nil {
+			b.sched.charge(b.flow, now, n-reserve, n-len(p))
+		}
+	}
+	if n > 0 {
+		now = c.clock.Now()
+		for _, u := range b.usages {
+			u.add(now, n)
+		}
+	}
 	return
 }
 
+// reserveN reserves n tokens from each of the limiters. If any of them
+// cannot fulfill the reservation, all of the reservations made so far
+// are cancelled. A nil slice without an error means that n exceeds
+// the burst of one of the limiters, and the caller should try again
+// with a smaller n.
+func reserveN(limiters []*rate.Limiter, t time.Time, n int) ([]*rate.Reservation, error) {
+	ret := make([]*rate.Reservation, 0, len(limiters))
+	for _, lim := range limiters {
+		r := lim.ReserveN(t, n)
+		if !r.OK() {
+			cancelAt(ret, t)
+			// The burst may have been lowered concurrently, so a smaller
+			// chunk is worth a try, unless no chunk can fit at all.
+			if n > lim.Burst() && lim.Burst() > 0 {
+				return nil, nil
+			}
+			return nil, ErrUnfulfillableReservation
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// cancelAt cancels the reservations in reverse order.
+func cancelAt(reservations []*rate.Reservation, t time.Time) {
+	for i := len(reservations) - 1; i >= 0; i-- {
+		reservations[i].CancelAt(t)
+	}
+}
+
+// chunk returns the maximum size of a single I/O operation,
+// which is the lowest of the limiters' bursts. The last
+// of the limiters is expected to be the local one.
+func chunk(limiters []*rate.Limiter) int {
+	local := limiters[len(limiters)-1]
+
+	size := local.Burst()
+	for _, lim := range limiters[:len(limiters)-1] {
+		// The burst of an unlimited limiter is meaningless.
+		if lim.Limit() != rate.Inf {
+			size = min(size, lim.Burst())
+		}
+	}
+	return max(size, 1)
+}
+
+// wait blocks for the duration d, unless the deadline passes, the connection
+// gets closed or the context is done in the meantime. A negative duration
+// makes it block until one of these happens, or until the wake channel
+// gets closed, in which case woken is set.
+func (c *conn) wait(ctx context.Context, d time.Duration, dl *deadline,
+	wake <-chan struct{}) (woken bool, err error) {
+	var elapsed <-chan time.Time
+	if d >= 0 {
+		var stop func() bool
+		elapsed, stop = c.clock.NewTimer(d)
+		defer stop()
+	}
+
+	for {
+		t, changed := dl.get()
+
+		var expired <-chan time.Time
+		stopExpired := func() bool { return false }
+		if !t.IsZero() {
+			left := t.Sub(c.clock.Now())
+			if left <= 0 {
+				return false, os.ErrDeadlineExceeded
+			}
+			expired, stopExpired = c.clock.NewTimer(left)
+		}
+
+		select {
+		case <-elapsed:
+			stopExpired()
+			return false, nil
+		case <-wake:
+			stopExpired()
+			return true, nil
+		case <-expired:
+			return false, os.ErrDeadlineExceeded
+		case <-changed:
+			stopExpired()
+		case <-c.closed:
+			stopExpired()
+			return false, net.ErrClosed
+		case <-ctx.Done():
+			stopExpired()
+			return false, ctx.Err()
+		}
+	}
+}
+
 func (c *conn) Read(p []byte) (int, error) {
+	return c.ReadContext(context.Background(), p)
+}
+
+func (c *conn) ReadContext(ctx context.Context, p []byte) (n int, err error) {
 	// We are limiting read operation to be capped
-	// to the chunk size (== max allowed burst).
-	return c.do(
-		p[:min(chunkSize, len(p))],
+	// to the chunk size (== max allowed burst). As we can't tell
+	// how many bytes are there to read, we only wait until the limiters
+	// are out of debt, and charge them for what was actually read.
+	p, err = c.injected(ctx, p, false, &c.readDeadline)
+	if err != nil {
+		return
+	}
+	n, err = c.do(
+		ctx,
+		p,
+		false,
+		c.read,
+		&c.readDeadline,
 		c.Conn.Read,
 	)
+	c.stats.addRead(n)
+	c.transferred(n)
+	return
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	return c.WriteContext(context.Background(), p)
 }
 
-func (c *conn) Write(p []byte) (n int, err error) {
-	// Write is expected to write the whole buffer,
-	// so we partition it by chunks (<= limiter's max allowed burst).
-	forEachChunk(p, chunkSize, func(p []byte) bool {
+func (c *conn) WriteContext(ctx context.Context, p []byte) (n int, err error) {
+	// Write is expected to write the whole buffer, so we partition it
+	// by chunks (<= limiter's max allowed burst), leaving it up to do
+	// to decide on the chunk size, as the bursts may change meanwhile.
+	write := c.Conn.Write
+	if c.link != nil {
+		write = func(p []byte) (int, error) {
+			return c.link.send(ctx, c.closed, p)
+		}
+	}
+	for n < len(p) {
+		var chunk []byte
+		chunk, err = c.injected(ctx, p[n:], true, &c.writeDeadline)
+		if err != nil {
+			return
+		}
+
 		var nn int
-		nn, err = c.do(p, c.Conn.Write)
+		nn, err = c.do(ctx, chunk, true, c.write, &c.writeDeadline, write)
+		c.stats.addWritten(nn)
+		c.transferred(nn)
 		n += nn
-		return err == nil
-	})
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
+func (c *conn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetDeadline(t); err != nil {
+		return err
+	}
+
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	if err := c.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+
+	c.writeDeadline.set(t)
+	return nil
+}
+
 func (c *conn) SetLimit(limit rate.Limit) error {
 	if limit < 0 {
 		return ErrInvalidLimit
 	}
 
-	c.localLimiter.SetLimitAt(c.clock.Now(), limit)
+	now := c.clock.Now()
+	c.mu.Lock()
+	c.readInherited = false
+	c.writeInherited = false
+	c.burst.setLimitAt(c.read.local, now, limit)
+	c.burst.setLimitAt(c.write.local, now, limit)
+	c.mu.Unlock()
 	return nil
 }
 
 func (c *conn) Limit() rate.Limit {
-	return c.localLimiter.Limit()
+	return min(c.ReadLimit(), c.WriteLimit())
 }
 
-func (c *conn) Close() error {
-	if c.close != nil {
-		c.close(c)
+func (c *conn) SetReadLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
 	}
-	return c.Conn.Close()
+
+	c.mu.Lock()
+	c.readInherited = false
+	c.burst.setLimitAt(c.read.local, c.clock.Now(), limit)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conn) ReadLimit() rate.Limit {
+	return c.read.local.Limit()
+}
+
+func (c *conn) SetWriteLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
+	}
+
+	c.mu.Lock()
+	c.writeInherited = false
+	c.burst.setLimitAt(c.write.local, c.clock.Now(), limit)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conn) WriteLimit() rate.Limit {
+	return c.write.local.Limit()
 }
 
-// forEachChunk divides the slice into a slice of subslices
-// capped to the size of elements.
-func forEachChunk[T any](p []T, size int, f func(p []T) bool) {
-	if size < 1 {
+func (c *conn) ResetLimit() {
+	if c.reset != nil {
+		c.reset(c)
 		return
 	}
+	c.resetLimits(rate.Inf, rate.Inf)
+}
+
+// inheritReadLimit sets the read limit, unless it is overridden.
+func (c *conn) inheritReadLimit(limit rate.Limit) {
+	c.mu.Lock()
+	if c.readInherited {
+		c.burst.setLimitAt(c.read.local, c.clock.Now(), limit)
+	}
+	c.mu.Unlock()
+}
+
+// inheritWriteLimit sets the write limit, unless it is overridden.
+func (c *conn) inheritWriteLimit(limit rate.Limit) {
+	c.mu.Lock()
+	if c.writeInherited {
+		c.burst.setLimitAt(c.write.local, c.clock.Now(), limit)
+	}
+	c.mu.Unlock()
+}
+
+// resetLimits sets both limits, marking them as inherited.
+func (c *conn) resetLimits(read, write rate.Limit) {
+	now := c.clock.Now()
+	c.mu.Lock()
+	c.readInherited = true
+	c.writeInherited = true
+	c.burst.setLimitAt(c.read.local, now, read)
+	c.burst.setLimitAt(c.write.local, now, write)
+	c.mu.Unlock()
+}
+
+func (c *conn) SetBurst(burst int) error {
+	if burst < 1 {
+		return ErrInvalidBurst
+	}
+
+	now := c.clock.Now()
+	c.mu.Lock()
+	c.burst = burstPolicy{size: burst}
+	c.read.local.SetBurstAt(now, burst)
+	c.write.local.SetBurstAt(now, burst)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conn) Burst() int {
+	return min(c.read.local.Burst(), c.write.local.Burst())
+}
 
-	var j int
-	for i := 0; i < len(p); i += size {
-		j += size
-		if j > len(p) {
-			j = len(p)
+func (c *conn) SetWeight(weight float64) error {
+	if !(weight > 0) || math.IsInf(weight, 1) {
+		return ErrInvalidWeight
+	}
+
+	c.mu.Lock()
+	c.weight = weight
+	c.setClass()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conn) Weight() (ret float64) {
+	c.mu.Lock()
+	ret = c.weight
+	c.mu.Unlock()
+	return
+}
+
+func (c *conn) SetPriority(priority int) {
+	c.mu.Lock()
+	c.priority = priority
+	c.setClass()
+	c.mu.Unlock()
+}
+
+func (c *conn) Priority() (ret int) {
+	c.mu.Lock()
+	ret = c.priority
+	c.mu.Unlock()
+	return
+}
+
+// setClass propagates the weight and priority to the schedulers.
+// The mutex is expected to be held.
+func (c *conn) setClass() {
+	for _, b := range []buckets{c.read, c.write} {
+		if b.sched != nil {
+			b.sched.setClass(b.flow, c.weight, c.priority)
 		}
+	}
+}
 
-		if !f(p[i:j]) {
-			return
+func (c *conn) Stats() ConnStats {
+	return ConnStats{
+		BytesRead:    c.stats.bytesRead.Load(),
+		BytesWritten: c.stats.bytesWritten.Load(),
+		Throttled:    c.stats.throttled.Load(),
+		Throttling:   time.Duration(c.stats.throttling.Load()),
+		Dropped:      c.stats.dropped.Load(),
+		Created:      c.created,
+	}
+}
+
+func (c *conn) ID() uint64 {
+	return c.id
+}
+
+func (c *conn) SetLabel(key, value string) {
+	c.mu.Lock()
+	if value == "" {
+		delete(c.labels, key)
+	} else {
+		if c.labels == nil {
+			c.labels = make(map[string]string)
 		}
+		c.labels[key] = value
+	}
+	c.mu.Unlock()
+}
+
+func (c *conn) Labels() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.labels)
+}
+
+// info describes the connection.
+func (c *conn) info() ConnInfo {
+	return ConnInfo{
+		ID:         c.id,
+		LocalAddr:  c.LocalAddr(),
+		RemoteAddr: c.RemoteAddr(),
+		ReadLimit:  c.ReadLimit(),
+		WriteLimit: c.WriteLimit(),
+		Labels:     c.Labels(),
+		Stats:      c.Stats(),
+	}
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.link != nil {
+			c.link.close()
+		}
+		if c.close != nil {
+			c.close(c.outer)
+		}
+	})
+	return c.Conn.Close()
+}
+
+// isClosed tells whether the connection is closed already.
+func (c *conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// chargeN charges the limiter with n tokens, without waiting for them.
+// A negative n gives the unused tokens back.
+func chargeN(lim *rate.Limiter, t time.Time, n int) {
+	// Both infinite and zero limits don't track tokens (the latter
+	// consumes its burst instead), so they are left intact. Otherwise,
+	// rate.Limiter has no dedicated method for that, but a reservation
+	// does exactly this, even for a negative number of tokens, which are
+	// capped to the burst with the next limiter's advance. A zero burst
+	// holds no tokens to charge.
+	if limit := lim.Limit(); limit == rate.Inf || limit == 0 || lim.Burst() <= 0 {
+		return
+	}
+	// A reservation cannot exceed the burst, so larger charges
+	// (e.g. of datagrams) are split.
+	for burst := lim.Burst(); n > burst; n -= burst {
+		lim.ReserveN(t, burst)
 	}
+	lim.ReserveN(t, n)
 }
 
 // wrapConn wraps net.Conn into bandwidth-limitable implementation.
 // Conn's will be unlimited, but can be set implicitly using SetLimit.
-func wrapConn(nc net.Conn, global, local *rate.Limiter, clock Clock,
-	close func(Conn)) Conn {
-	return &conn{
-		Conn:          nc,
-		globalLimiter: global,
-		localLimiter:  local,
-		clock:         clock,
-		close:         close,
+func wrapConn(nc net.Conn, read, write buckets, burst burstPolicy,
+	clock Clock, stats *counters, close func(Conn)) *conn {
+	ret := &conn{
+		Conn:           nc,
+		read:           read,
+		write:          write,
+		burst:          burst,
+		weight:         1,
+		clock:          clock,
+		stats:          counters{parent: stats},
+		created:        clock.Now(),
+		readInherited:  true,
+		writeInherited: true,
+		close:          close,
+		closed:         make(chan struct{}),
 	}
+	ret.outer = expose(ret)
+	return ret
 }
@@ -2,9 +2,11 @@ package tcplimit
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
-	"reflect"
+	"net"
+	"os"
 	"testing"
 	"time"
 
@@ -12,69 +14,22 @@ import (
 	"golang.org/x/time/rate"
 )
 
-func TestForEachChunk(t *testing.T) {
-	for _, test := range []struct {
-		name     string
-		input    []int
-		size     int
-		expected [][]int
-	}{
-		{
-			name:  "invalid chunk size",
-			input: []int{1, 2, 3},
-			size:  -1,
-		},
-		{
-			name:  "zero chunk size",
-			input: []int{1, 2, 3},
-			size:  0,
-		},
-		{
-			name:     "individual elements",
-			input:    []int{1, 2, 3},
-			size:     1,
-			expected: [][]int{{1}, {2}, {3}},
-		},
-		{
-			name:     "even and odd sized elements",
-			input:    []int{1, 2, 3},
-			size:     2,
-			expected: [][]int{{1, 2}, {3}},
-		},
-		{
-			name:     "one element #1",
-			input:    []int{1, 2, 3},
-			size:     3,
-			expected: [][]int{{1, 2, 3}},
-		},
-		{
-			name:     "one element #2",
-			input:    []int{1, 2, 3},
-			size:     4,
-			expected: [][]int{{1, 2, 3}},
-		},
-	} {
-		t.Run(test.name, func(t *testing.T) {
-			var got [][]int
-			forEachChunk(test.input, test.size, func(p []int) bool {
-				got = append(got, p)
-				return true
-			})
-			if !reflect.DeepEqual(test.expected, got) {
-				t.Errorf("Expected %v, got %v", test.expected, got)
-			}
-		})
-	}
-}
-
 func TestConnErrUnfulfillableLocalReservation(t *testing.T) {
 	var input = makeByteSliceWithTestData(chunkSize * 10)
 
 	conn := wrapConn(
 		mock.NewNoopConn(),
-		rate.NewLimiter(rate.Inf, 0),
-		rate.NewLimiter(rate.Limit(0), chunkSize),
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, 0)},
+			local:  rate.NewLimiter(rate.Limit(0), chunkSize),
+		},
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, 0)},
+			local:  rate.NewLimiter(rate.Limit(0), chunkSize),
+		},
+		defaultBurstPolicy,
 		defaultClock,
+		nil,
 		func(Conn) {},
 	)
 	defer conn.Close()
@@ -94,6 +49,33 @@ func TestConnErrUnfulfillableLocalReservation(t *testing.T) {
 	})
 }
 
+func TestConnErrUnfulfillableZeroBurst(t *testing.T) {
+	conn := wrapConn(
+		mock.NewNoopConn(),
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, 0)},
+			local:  rate.NewLimiter(rate.Limit(1000), 0),
+		},
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, 0)},
+			local:  rate.NewLimiter(rate.Limit(1000), 0),
+		},
+		defaultBurstPolicy,
+		defaultClock,
+		nil,
+		func(Conn) {},
+	)
+	defer conn.Close()
+
+	// A finite limit with no burst must fail, instead of retrying forever.
+	if _, err := conn.Write(make([]byte, 10)); !errors.Is(err, ErrUnfulfillableReservation) {
+		t.Errorf("expected %s, got %s", ErrUnfulfillableReservation, err)
+	}
+	if _, err := conn.Read(make([]byte, 10)); !errors.Is(err, ErrUnfulfillableReservation) {
+		t.Errorf("expected %s, got %s", ErrUnfulfillableReservation, err)
+	}
+}
+
 func TestConnReadWriteConsistency(t *testing.T) {
 	now := time.Now()
 	clock := &mock.Clock{
@@ -109,9 +91,17 @@ func TestConnReadWriteConsistency(t *testing.T) {
 
 		conn := wrapConn(
 			mock.NewBufferConn(expected),
-			rate.NewLimiter(rate.Inf, 0),
-			rate.NewLimiter(rate.Limit(3), chunkSize),
+			buckets{
+				shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, 0)},
+				local:  rate.NewLimiter(rate.Limit(3), chunkSize),
+			},
+			buckets{
+				shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, 0)},
+				local:  rate.NewLimiter(rate.Limit(3), chunkSize),
+			},
+			defaultBurstPolicy,
 			clock,
+			nil,
 			func(Conn) {},
 		)
 		defer conn.Close()
@@ -133,9 +123,17 @@ func TestConnReadWriteConsistency(t *testing.T) {
 		got := mock.NewBufferConn(nil)
 		conn := wrapConn(
 			got,
-			rate.NewLimiter(rate.Inf, 0),
-			rate.NewLimiter(rate.Limit(3), chunkSize),
+			buckets{
+				shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, 0)},
+				local:  rate.NewLimiter(rate.Limit(3), chunkSize),
+			},
+			buckets{
+				shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, 0)},
+				local:  rate.NewLimiter(rate.Limit(3), chunkSize),
+			},
+			defaultBurstPolicy,
 			clock,
+			nil,
 			func(Conn) {},
 		)
 		defer conn.Close()
@@ -154,9 +152,17 @@ func TestConnReadWriteConsistency(t *testing.T) {
 func TestConnInvalidLimit(t *testing.T) {
 	conn := wrapConn(
 		mock.NewNoopConn(),
-		rate.NewLimiter(rate.Inf, 0),
-		rate.NewLimiter(rate.Inf, 0),
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, 0)},
+			local:  rate.NewLimiter(rate.Inf, 0),
+		},
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, 0)},
+			local:  rate.NewLimiter(rate.Inf, 0),
+		},
+		defaultBurstPolicy,
 		defaultClock,
+		nil,
 		func(Conn) {},
 	)
 	defer conn.Close()
@@ -167,6 +173,227 @@ func TestConnInvalidLimit(t *testing.T) {
 	}
 }
 
+func TestConnIndependentDirections(t *testing.T) {
+	var slept time.Duration
+	now := time.Now()
+	clock := &mock.Clock{
+		OnNow: func() time.Time {
+			return now
+		},
+		OnSleep: func(d time.Duration) {
+			slept += d
+		},
+	}
+
+	conn := wrapConn(
+		mock.NewNoopConn(),
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, chunkSize)},
+			local:  rate.NewLimiter(rate.Limit(chunkSize), chunkSize),
+		},
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, chunkSize)},
+			local:  rate.NewLimiter(rate.Inf, chunkSize),
+		},
+		defaultBurstPolicy,
+		clock,
+		nil,
+		func(Conn) {},
+	)
+	defer conn.Close()
+
+	if _, err := conn.Write(makeByteSliceWithTestData(chunkSize * 10)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if slept != 0 {
+		t.Errorf("expected write not to be throttled, slept for %s", slept)
+	}
+
+	// Reads are charged after the fact, so the third one waits
+	// for the second one to be paid off.
+	var p [chunkSize]byte
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Read(p[:]); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	if slept != time.Second {
+		t.Errorf("expected read to be throttled for %s, got %s", time.Second, slept)
+	}
+}
+
+func TestConnWaitInterruption(t *testing.T) {
+	newThrottledConn := func() (Conn, *rate.Limiter) {
+		local := rate.NewLimiter(rate.Limit(1), chunkSize)
+		return wrapConn(
+			mock.NewNoopConn(),
+			buckets{
+				shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, chunkSize)},
+				local:  rate.NewLimiter(rate.Inf, chunkSize),
+			},
+			buckets{
+				shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, chunkSize)},
+				local:  local,
+			},
+			defaultBurstPolicy,
+			defaultClock,
+			nil,
+			func(Conn) {},
+		), local
+	}
+
+	for _, test := range []struct {
+		name      string
+		interrupt func(Conn) context.Context
+		expected  error
+	}{
+		{
+			name: "deadline",
+			interrupt: func(conn Conn) context.Context {
+				conn.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+				return context.Background()
+			},
+			expected: os.ErrDeadlineExceeded,
+		},
+		{
+			name: "deadline changed while waiting",
+			interrupt: func(conn Conn) context.Context {
+				conn.SetWriteDeadline(time.Now().Add(time.Hour))
+				time.AfterFunc(10*time.Millisecond, func() {
+					conn.SetDeadline(time.Now())
+				})
+				return context.Background()
+			},
+			expected: os.ErrDeadlineExceeded,
+		},
+		{
+			name: "close",
+			interrupt: func(conn Conn) context.Context {
+				time.AfterFunc(10*time.Millisecond, func() {
+					conn.Close()
+				})
+				return context.Background()
+			},
+			expected: net.ErrClosed,
+		},
+		{
+			name: "context",
+			interrupt: func(conn Conn) context.Context {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(10*time.Millisecond, cancel)
+				return ctx
+			},
+			expected: context.Canceled,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, local := newThrottledConn()
+			defer conn.Close()
+
+			ctx := test.interrupt(conn)
+
+			// The first chunk fits in the burst, the second one would
+			// have to wait for another chunkSize seconds.
+			n, err := conn.WriteContext(ctx, makeByteSliceWithTestData(chunkSize*2))
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected %s, got %s", test.expected, err)
+			}
+			if n != chunkSize {
+				t.Errorf("expected %d bytes written, got %d", chunkSize, n)
+			}
+			if tokens := local.Tokens(); tokens < 0 {
+				t.Errorf("expected reservation to be cancelled, got %f tokens", tokens)
+			}
+		})
+	}
+}
+
+func TestConnShortReadCharge(t *testing.T) {
+	var slept time.Duration
+	now := time.Now()
+	clock := &mock.Clock{
+		OnNow: func() time.Time {
+			return now
+		},
+		OnSleep: func(d time.Duration) {
+			slept += d
+			now = now.Add(d)
+		},
+	}
+
+	conn := wrapConn(
+		mock.NewShortReadConn(mock.NewNoopConn(), 100),
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Limit(chunkSize), chunkSize)},
+			local:  rate.NewLimiter(rate.Limit(chunkSize), chunkSize),
+		},
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, chunkSize)},
+			local:  rate.NewLimiter(rate.Inf, chunkSize),
+		},
+		defaultBurstPolicy,
+		clock,
+		nil,
+		func(Conn) {},
+	)
+	defer conn.Close()
+
+	// Every read gets charged only for the 100 bytes it read,
+	// so ten of them fit in a single chunk of the burst.
+	var p [chunkSize]byte
+	for i := 0; i < 10; i++ {
+		n, err := conn.Read(p[:])
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if n != 100 {
+			t.Fatalf("expected 100 bytes read, got %d", n)
+		}
+	}
+	if slept != 0 {
+		t.Errorf("expected reads not to be throttled, slept for %s", slept)
+	}
+}
+
+func TestConnSetBurst(t *testing.T) {
+	conn := wrapConn(
+		mock.NewNoopConn(),
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, chunkSize)},
+			local:  rate.NewLimiter(rate.Limit(chunkSize), chunkSize),
+		},
+		buckets{
+			shared: []*rate.Limiter{rate.NewLimiter(rate.Inf, chunkSize)},
+			local:  rate.NewLimiter(rate.Limit(chunkSize), chunkSize),
+		},
+		defaultBurstPolicy,
+		defaultClock,
+		nil,
+		func(Conn) {},
+	)
+	defer conn.Close()
+
+	if err := conn.SetBurst(0); !errors.Is(err, ErrInvalidBurst) {
+		t.Errorf("expected %s, got %s", ErrInvalidBurst, err)
+	}
+
+	if err := conn.SetBurst(10); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// The burst should survive the limit change.
+	conn.SetLimit(rate.Limit(1024 * 1024))
+
+	var p [chunkSize]byte
+	n, err := conn.Read(p[:])
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if n != 10 {
+		t.Errorf("expected read to be capped to %d bytes, got %d", 10, n)
+	}
+}
+
 func makeByteSliceWithTestData(n int) (ret []byte) {
 	ret = make([]byte, n)
 	for i := range ret {
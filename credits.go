@@ -0,0 +1,49 @@
+package tcplimit
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Credits configure the burstable mode of the connections. While
+// a connection transfers below its baseline rate (or stays idle), it earns
+// credits, up to the cap. Then, it can spend them transferring above
+// the baseline rate, as fast as its local limit allows, until they run out.
+//
+// Each direction of traffic earns and spends its own credits.
+type Credits struct {
+	// Baseline is the rate (bytes per second) the credits are earned at,
+	// which is also the rate sustained after they run out. It must
+	// be positive.
+	Baseline rate.Limit
+	// Cap is the maximum number of credits (bytes) to accumulate.
+	Cap int
+	// Initial is the number of credits new connections start with,
+	// e.g. to let short requests finish fast, while long downloads
+	// settle at the baseline rate.
+	Initial int
+}
+
+// newLimiter creates a limiter keeping track of the credits,
+// which are the limiter's tokens.
+func (c *Credits) newLimiter(now time.Time) *rate.Limiter {
+	ret := rate.NewLimiter(c.Baseline, c.Cap)
+	// The limiter starts full, so the credits over the initial
+	// ones are spent right away.
+	chargeN(ret, now, c.Cap-min(max(c.Initial, 0), c.Cap))
+	return ret
+}
+
+// WithCredits is a Limiter option that puts the connections into
+// the burstable mode. See Credits for more information. Note that
+// the credits let the connections exceed neither their local limits,
+// nor the global ones. The credits without a positive Baseline and Cap
+// are ignored.
+func WithCredits(credits Credits) LimiterOption {
+	return func(l *Limiter) {
+		if credits.Baseline > 0 && credits.Cap > 0 {
+			l.credits = &credits
+		}
+	}
+}
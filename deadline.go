@@ -0,0 +1,38 @@
+package tcplimit
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline holds a connection's deadline and lets the throttled operations
+// learn about its changes while they are waiting.
+type deadline struct {
+	mu      sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+// set sets a new deadline, waking up everyone waiting on the old one.
+// A zero value of t means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+		d.changed = nil
+	}
+	d.mu.Unlock()
+}
+
+// get returns the current deadline along with a channel, which is closed
+// when the deadline changes.
+func (d *deadline) get() (t time.Time, changed <-chan struct{}) {
+	d.mu.Lock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	t, changed = d.t, d.changed
+	d.mu.Unlock()
+	return
+}
@@ -0,0 +1,168 @@
+package tcplimit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// Dialer dials bandwidth-limited connections, e.g. to shape the outbound
+// traffic of a client, the way LimitedListener shapes the inbound traffic
+// of a server.
+//
+// Dialer's methods can be used concurrently.
+type Dialer struct {
+	dialer  *net.Dialer
+	limiter *Limiter
+	// hosts, when set, groups the connections by their destination host.
+	hosts *KeyedLimiter
+	// grouped and hostOpts tell whether to group the connections
+	// by their host, and how to configure the hosts' KeyedLimiter.
+	grouped  bool
+	hostOpts []KeyedLimiterOption
+}
+
+// Dial connects to the address on the named network, returning
+// a bandwidth-limited connection. See net.Dial for more information.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using
+// the provided context, returning a bandwidth-limited connection.
+// See net.Dialer.DialContext for more information.
+func (d *Dialer) DialContext(ctx context.Context, network,
+	address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.hosts != nil {
+		return d.hosts.limitConn(conn, dialHost(address)), nil
+	}
+	return d.limiter.LimitConn(conn), nil
+}
+
+// Hosts returns the limits of the destination hosts, which allows
+// to change them during runtime. Returns nil, unless WithHostGrouping
+// is used.
+func (d *Dialer) Hosts() *HostLimits {
+	if d.hosts == nil {
+		return nil
+	}
+	return &HostLimits{hosts: d.hosts}
+}
+
+// Transport returns a new http.Transport, which dials the connections
+// with the Dialer. Other than that, it is configured like
+// http.DefaultTransport.
+func (d *Dialer) Transport() *http.Transport {
+	ret := http.DefaultTransport.(*http.Transport).Clone()
+	ret.DialContext = d.DialContext
+	return ret
+}
+
+// Client returns a new http.Client, which dials the connections
+// with the Dialer. See Transport for more information.
+func (d *Dialer) Client() *http.Client {
+	return &http.Client{Transport: d.Transport()}
+}
+
+// dialHost returns the host of the dialed address, which is used
+// as the key of its group.
+func dialHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return strings.ToLower(host)
+}
+
+// HostLimits are the per-host limits of a Dialer grouping the connections
+// by their destination host (see WithHostGrouping). Unlike KeyedLimiter,
+// it cannot limit the connections by itself, as their hosts are known
+// to the Dialer only.
+type HostLimits struct {
+	hosts *KeyedLimiter
+}
+
+// SetLimit sets the aggregate limit of every host to Limit bytes per second
+// for both read and write directions.
+//
+// Returns ErrInvalidLimit when Limit is negative.
+func (h *HostLimits) SetLimit(limit rate.Limit) error {
+	return h.hosts.SetLimit(limit)
+}
+
+// SetReadLimit sets the aggregate limit of every host for the read direction
+// only. See SetLimit for more information.
+func (h *HostLimits) SetReadLimit(limit rate.Limit) error {
+	return h.hosts.SetReadLimit(limit)
+}
+
+// SetWriteLimit sets the aggregate limit of every host for the write direction
+// only. See SetLimit for more information.
+func (h *HostLimits) SetWriteLimit(limit rate.Limit) error {
+	return h.hosts.SetWriteLimit(limit)
+}
+
+// Keys returns the hosts currently tracked, including the idle ones,
+// which are not evicted yet.
+func (h *HostLimits) Keys() []string {
+	return h.hosts.Keys()
+}
+
+type DialerOption func(*Dialer)
+
+// WithNetDialer is a Dialer option that makes the Dialer dial
+// the connections with the given net.Dialer, e.g. to set the timeouts
+// or the local address.
+func WithNetDialer(dialer *net.Dialer) DialerOption {
+	return func(d *Dialer) {
+		d.dialer = dialer
+	}
+}
+
+// WithDialerLimiter is a Dialer option that makes the Dialer use
+// the given Limiter, instead of a new one.
+func WithDialerLimiter(limiter *Limiter) DialerOption {
+	return func(d *Dialer) {
+		d.limiter = limiter
+	}
+}
+
+// WithHostGrouping is a Dialer option that groups the connections
+// by their destination host (as dialed, before resolving), giving every
+// host its own aggregate bucket, e.g. to respect per-site bandwidth
+// budgets. The options configure the hosts' KeyedLimiter, e.g. with
+// WithKeyLimit.
+func WithHostGrouping(opts ...KeyedLimiterOption) DialerOption {
+	return func(d *Dialer) {
+		d.grouped = true
+		d.hostOpts = opts
+	}
+}
+
+// NewDialer creates a new Dialer.
+func NewDialer(opts ...DialerOption) *Dialer {
+	ret := &Dialer{}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	if ret.dialer == nil {
+		ret.dialer = &net.Dialer{}
+	}
+	if ret.limiter == nil {
+		ret.limiter = NewLimiter()
+	}
+	if ret.grouped {
+		ret.hosts = ret.limiter.NewKeyedLimiter(RemoteIP, ret.hostOpts...)
+	}
+	return ret
+}
@@ -0,0 +1,110 @@
+package tcplimit_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ksinica/tcplimit"
+	"github.com/ksinica/tcplimit/internal/pkg/mock"
+	"golang.org/x/time/rate"
+)
+
+func TestDialerHostGrouping(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	var slept time.Duration
+	now := time.Now()
+	dialer := tcplimit.NewDialer(
+		tcplimit.WithDialerLimiter(tcplimit.NewLimiter(
+			tcplimit.WithClock(&mock.Clock{
+				OnNow: func() time.Time {
+					return now
+				},
+				OnSleep: func(d time.Duration) {
+					slept += d
+					now = now.Add(d)
+				},
+			}),
+		)),
+		tcplimit.WithHostGrouping(tcplimit.WithKeyWriteLimit(rate.Limit(1024))),
+	)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := dialer.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+
+		if _, err := conn.Write(make([]byte, 1024)); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	// The second connection to the host should wait for the bucket
+	// drained by the first one.
+	if slept != time.Second {
+		t.Errorf("expected writes to be throttled for %s, got %s", time.Second, slept)
+	}
+	if keys := dialer.Hosts().Keys(); !slices.Equal(keys, []string{"127.0.0.1"}) {
+		t.Errorf("expected the host to be tracked, got %v", keys)
+	}
+
+	// Changing the hosts' limits applies to the dialed connections.
+	if err := dialer.Hosts().SetWriteLimit(rate.Inf); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	slept = 0
+	for _, conn := range conns {
+		if _, err := conn.Write(make([]byte, 4096)); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	if slept != 0 {
+		t.Errorf("expected writes not to be throttled, got %s", slept)
+	}
+}
+
+func TestDialerClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 4096))
+	}))
+	defer server.Close()
+
+	limiter := tcplimit.NewLimiter()
+	client := tcplimit.NewDialer(tcplimit.WithDialerLimiter(limiter)).Client()
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if stats := limiter.Stats(); stats.TotalConns != 1 || stats.BytesRead < 4096 {
+		t.Errorf("expected the download to go through the limiter, got %+v", stats)
+	}
+}
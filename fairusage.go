@@ -0,0 +1,143 @@
+package tcplimit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// FairUsage is a fair-usage policy: once a connection (or a group) has
+// transferred Threshold bytes (read and written together) within
+// the current window, its limit drops to a lower tier, until the window
+// rolls over.
+type FairUsage struct {
+	// Threshold is the number of bytes, after which the limit drops.
+	Threshold int64
+	// Window is the duration of a window, zero meaning that the window
+	// never rolls over.
+	Window time.Duration
+	// Limit is the limit of the lower tier, for both read and write
+	// directions. It takes precedence over the regular limits, when
+	// they are higher.
+	Limit rate.Limit
+}
+
+// TierChange describes a change of the fair-usage tier.
+type TierChange struct {
+	// Conn is the connection, which changed the tier, or nil
+	// if it was a Group.
+	Conn Conn
+	// Group is the Group, which changed the tier, or nil
+	// if it was a connection.
+	Group *Group
+	// Downgraded tells whether the limit dropped to the lower tier,
+	// or got back to the regular one.
+	Downgraded bool
+	// Time is the time of the change.
+	Time time.Time
+}
+
+// TierObserver is notified of the fair-usage tier changes. Observers are
+// called synchronously by the I/O operations, so they should not block.
+type TierObserver func(TierChange)
+
+// fairUsage tracks the traffic of a connection or a group, applying
+// the fair-usage policy through its own pair of limiters, which are
+// unlimited unless the tier is lowered.
+type fairUsage struct {
+	policy    FairUsage
+	observers []TierObserver
+	burst     burstPolicy
+	read      *rate.Limiter
+	write     *rate.Limiter
+	// change is a template of the TierChange passed to the observers.
+	change     TierChange
+	mu         sync.Mutex
+	start      time.Time
+	used       int64
+	downgraded bool
+}
+
+func newFairUsage(policy FairUsage, observers []TierObserver,
+	burst burstPolicy, now time.Time) *fairUsage {
+	return &fairUsage{
+		policy:    policy,
+		observers: observers,
+		burst:     burst,
+		read:      burst.newLimiter(rate.Inf),
+		write:     burst.newLimiter(rate.Inf),
+		start:     now,
+	}
+}
+
+// check gets back to the regular tier, when the window rolls over.
+func (f *fairUsage) check(now time.Time) {
+	f.mu.Lock()
+	changed := f.advance(now)
+	f.mu.Unlock()
+
+	if changed {
+		f.notify(false, now)
+	}
+}
+
+// add accounts n bytes transferred, dropping to the lower tier,
+// when the threshold is reached.
+func (f *fairUsage) add(now time.Time, n int) {
+	f.mu.Lock()
+	upgraded := f.advance(now)
+	f.used += int64(n)
+	downgraded := !f.downgraded && f.used >= f.policy.Threshold
+	if downgraded {
+		f.downgraded = true
+		f.setLimitAt(now, f.policy.Limit)
+	}
+	f.mu.Unlock()
+
+	if upgraded {
+		f.notify(false, now)
+	}
+	if downgraded {
+		f.notify(true, now)
+	}
+}
+
+// advance starts a new window, when the current one is over,
+// telling whether the tier got back to the regular one.
+// The mutex is expected to be held.
+func (f *fairUsage) advance(now time.Time) bool {
+	if f.policy.Window <= 0 {
+		return false
+	}
+
+	elapsed := now.Sub(f.start)
+	if elapsed < f.policy.Window {
+		return false
+	}
+	f.start = f.start.Add(elapsed / f.policy.Window * f.policy.Window)
+	f.used = 0
+
+	if !f.downgraded {
+		return false
+	}
+	f.downgraded = false
+	f.setLimitAt(now, rate.Inf)
+	return true
+}
+
+// setLimitAt sets the limit of both limiters.
+// The mutex is expected to be held.
+func (f *fairUsage) setLimitAt(now time.Time, limit rate.Limit) {
+	f.burst.setLimitAt(f.read, now, limit)
+	f.burst.setLimitAt(f.write, now, limit)
+}
+
+func (f *fairUsage) notify(downgraded bool, now time.Time) {
+	change := f.change
+	change.Downgraded = downgraded
+	change.Time = now
+	for _, observer := range f.observers {
+		observer(change)
+	}
+}
@@ -0,0 +1,251 @@
+package tcplimit
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidFaults = errors.New("invalid faults")
+	// ErrFaultInjected means that the operation failed because
+	// of an injected fault.
+	ErrFaultInjected = errors.New("fault injected")
+)
+
+// Faults are the faults injected into a connection, e.g. to test
+// the behaviour of its peer on a bad network. The zero Faults inject
+// no faults at all.
+type Faults struct {
+	// CloseAfterBytes, when positive, closes the connection once it has
+	// transferred that many bytes (read and written together), truncating
+	// the operation reaching the limit.
+	CloseAfterBytes int64
+	// CloseAfter, when positive, closes the connection after
+	// the duration.
+	CloseAfter time.Duration
+	// Reset makes the connection close abortively (e.g. with a TCP RST),
+	// when closed because of the faults, if the underlying connection
+	// supports it.
+	Reset bool
+	// Stall makes the operations wait for the duration, without
+	// any progress.
+	Stall time.Duration
+	// ErrorRate is the probability of an operation failing with
+	// ErrFaultInjected, between zero and one.
+	ErrorRate float64
+	// HalfClose shuts down the writing side of the connection, if
+	// the underlying connection supports it, making the writes fail
+	// with ErrFaultInjected.
+	HalfClose bool
+	// Seed seeds the randomness of the faults, so that they are
+	// reproducible. Each connection derives its own seed from Seed
+	// and its ID, so that the connections don't fail all at once.
+	Seed int64
+}
+
+func (f *Faults) valid() bool {
+	return f.CloseAfterBytes >= 0 && f.CloseAfter >= 0 && f.Stall >= 0 &&
+		f.ErrorRate >= 0 && f.ErrorRate <= 1
+}
+
+// faults are the Faults injected into a connection at a time.
+type faults struct {
+	config   Faults
+	start    time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+	rand     *rand.Rand
+	bytes    int64
+}
+
+func newFaults(config Faults, id uint64, now time.Time) *faults {
+	return &faults{
+		config: config,
+		start:  now,
+		stop:   make(chan struct{}),
+		rand:   rand.New(rand.NewSource(config.Seed + int64(id))),
+	}
+}
+
+// failing tells whether the next operation should fail.
+func (f *faults) failing() (ret bool) {
+	if f.config.ErrorRate == 0 {
+		return false
+	}
+
+	f.mu.Lock()
+	ret = f.rand.Float64() < f.config.ErrorRate
+	f.mu.Unlock()
+	return
+}
+
+// left returns the number of bytes left before closing the connection,
+// which is negative, when there is no such limit.
+func (f *faults) left() (ret int64) {
+	if f.config.CloseAfterBytes == 0 {
+		return -1
+	}
+
+	f.mu.Lock()
+	ret = max(f.config.CloseAfterBytes-f.bytes, 0)
+	f.mu.Unlock()
+	return
+}
+
+// add accounts n bytes transferred, telling whether the connection
+// should be closed now.
+func (f *faults) add(n int) (exhausted bool) {
+	if f.config.CloseAfterBytes == 0 {
+		return false
+	}
+
+	f.mu.Lock()
+	f.bytes += int64(n)
+	exhausted = f.bytes >= f.config.CloseAfterBytes
+	f.mu.Unlock()
+	return
+}
+
+func (f *faults) cancel() {
+	f.stopOnce.Do(func() {
+		close(f.stop)
+	})
+}
+
+// injectFaults replaces the faults injected into the connection.
+func (c *conn) injectFaults(config Faults) {
+	var next *faults
+	if config != (Faults{}) {
+		next = newFaults(config, c.id, c.clock.Now())
+	}
+
+	c.mu.Lock()
+	prev := c.faults
+	c.faults = next
+	c.mu.Unlock()
+
+	if prev != nil {
+		prev.cancel()
+	}
+	if next == nil {
+		return
+	}
+
+	if config.HalfClose {
+		if cw, ok := c.Conn.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}
+	if config.CloseAfter > 0 {
+		go c.abortAfter(next)
+	}
+}
+
+// abortAfter closes the connection, when the faults' time is up,
+// unless the faults are replaced or the connection is closed first.
+func (c *conn) abortAfter(f *faults) {
+	elapsed, stop := c.clock.NewTimer(f.config.CloseAfter)
+	defer stop()
+
+	select {
+	case <-elapsed:
+		c.abort(f)
+	case <-f.stop:
+	case <-c.closed:
+	}
+}
+
+// abort closes the connection because of the faults.
+func (c *conn) abort(f *faults) {
+	if f.config.Reset {
+		if tc, ok := c.Conn.(interface{ SetLinger(int) error }); ok {
+			tc.SetLinger(0)
+		}
+	}
+	c.Close()
+}
+
+// injected applies the faults (if any) to the operation on p, returning
+// the part of p the operation is allowed to transfer.
+func (c *conn) injected(ctx context.Context, p []byte, write bool,
+	dl *deadline) ([]byte, error) {
+	c.mu.Lock()
+	f := c.faults
+	c.mu.Unlock()
+	if f == nil {
+		return p, nil
+	}
+
+	if write && f.config.HalfClose {
+		return nil, ErrFaultInjected
+	}
+	if d := f.start.Add(f.config.Stall).Sub(c.clock.Now()); d > 0 {
+		if _, err := c.wait(ctx, d, dl, nil); err != nil {
+			return nil, err
+		}
+	}
+	if f.failing() {
+		return nil, ErrFaultInjected
+	}
+	if left := f.left(); left >= 0 {
+		if left == 0 {
+			c.abort(f)
+			return nil, net.ErrClosed
+		}
+		p = p[:min(int64(len(p)), left)]
+	}
+	return p, nil
+}
+
+// transferred accounts n bytes transferred for the faults (if any).
+func (c *conn) transferred(n int) {
+	c.mu.Lock()
+	f := c.faults
+	c.mu.Unlock()
+
+	if f != nil && f.add(n) {
+		c.abort(f)
+	}
+}
+
+// InjectFaults injects the faults into all of the connections wrapped
+// by the Limiter, including the ones wrapped afterwards, replacing
+// the faults injected so far. The timed faults start counting from
+// now for the existing connections, and from wrapping for the new ones.
+// The zero Faults stop injecting the faults.
+//
+// Returns ErrInvalidFaults when any of the parameters is out of range.
+func (l *Limiter) InjectFaults(faults Faults) error {
+	if !faults.valid() {
+		return ErrInvalidFaults
+	}
+
+	l.mu.Lock()
+	l.faults = faults
+	for conn := range l.conns {
+		conn.injectFaults(faults)
+	}
+	l.mu.Unlock()
+
+	return nil
+}
+
+// InjectConnFaults injects the faults into the connection, replacing
+// the faults injected so far. The zero Faults stop injecting the faults.
+//
+// Returns ErrInvalidFaults when any of the parameters is out of range,
+// or the connection is not wrapped by a Limiter.
+func (l *Limiter) InjectConnFaults(c Conn, faults Faults) error {
+	conn, ok := innerConn(c)
+	if !ok || !faults.valid() {
+		return ErrInvalidFaults
+	}
+
+	conn.injectFaults(faults)
+	return nil
+}
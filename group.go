@@ -0,0 +1,324 @@
+package tcplimit
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Group is a set of connections sharing an aggregate bandwidth limit.
+// Groups form a hierarchy (e.g. global → tenant → user → connection),
+// where the connections of a Group are bounded by the Group's own limits,
+// the limits of all of its ancestors and the global limits of the Limiter.
+// The local (per-connection) limits are still set by the Limiter.
+//
+// Group's methods can be used concurrently.
+type Group struct {
+	limiter      *Limiter
+	parent       *Group
+	readLimiter  *rate.Limiter
+	writeLimiter *rate.Limiter
+	// quota caps the number of bytes transferred by the connections
+	// of the Group.
+	quota *quota
+	// fairUsage is the fair-usage policy of the Group, if any.
+	fairUsage *fairUsage
+	// chain is what the connections of the Group are charged against,
+	// from the Limiter's global limiters down to the Group's own.
+	chain  chain
+	mu     sync.Mutex
+	conns  map[Conn]struct{}
+	groups map[*Group]struct{}
+	closed bool
+}
+
+// LimitConn wraps the given connection into a bandwidth-limited connection
+// belonging to the Group. If the Group is already closed, the connection
+// gets closed as well.
+func (g *Group) LimitConn(conn net.Conn) Conn {
+	return g.limitConn(conn, nil)
+}
+
+// limitConn acts like LimitConn, additionally calling the close callback
+// (if any) when the connection gets closed.
+func (g *Group) limitConn(conn net.Conn, close func(Conn)) Conn {
+	ret := g.limiter.limitConn(
+		conn,
+		g.chain,
+		func(c Conn) {
+			g.limiter.deleteConn(c)
+			g.deleteConn(c)
+			if close != nil {
+				close(c)
+			}
+		},
+	)
+
+	// The connection is closed already, when the Limiter is shut down.
+	inner, _ := innerConn(ret)
+	if inner.isClosed() {
+		return ret
+	}
+
+	g.mu.Lock()
+	closed := g.closed
+	if !closed {
+		g.conns[ret] = struct{}{}
+	}
+	g.mu.Unlock()
+
+	if closed {
+		ret.Close()
+	}
+	return ret
+}
+
+// NewGroup creates a new subgroup of the Group, bounded by its own
+// aggregate limits, as well as the limits of the Group.
+// If the Group is already closed, so is the subgroup.
+func (g *Group) NewGroup(opts ...GroupOption) *Group {
+	return newGroup(g.limiter, g, g.chain, opts)
+}
+
+// SetLimit sets the aggregate limit of the Group to Limit bytes per second
+// for both read and write directions.
+//
+// Returns ErrInvalidLimit when Limit is negative.
+func (g *Group) SetLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
+	}
+
+	now := g.limiter.clock.Now()
+	g.limiter.burst.setLimitAt(g.readLimiter, now, limit)
+	g.limiter.burst.setLimitAt(g.writeLimiter, now, limit)
+	return nil
+}
+
+// Limit returns the current aggregate Limit. When read and write limits
+// differ, the lower of them is returned.
+func (g *Group) Limit() rate.Limit {
+	return min(g.ReadLimit(), g.WriteLimit())
+}
+
+// SetReadLimit sets the aggregate limit for the read direction only.
+// See SetLimit for more information.
+func (g *Group) SetReadLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
+	}
+
+	g.limiter.burst.setLimitAt(g.readLimiter, g.limiter.clock.Now(), limit)
+	return nil
+}
+
+// ReadLimit returns the current aggregate read Limit.
+func (g *Group) ReadLimit() rate.Limit {
+	return g.readLimiter.Limit()
+}
+
+// SetWriteLimit sets the aggregate limit for the write direction only.
+// See SetLimit for more information.
+func (g *Group) SetWriteLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
+	}
+
+	g.limiter.burst.setLimitAt(g.writeLimiter, g.limiter.clock.Now(), limit)
+	return nil
+}
+
+// WriteLimit returns the current aggregate write Limit.
+func (g *Group) WriteLimit() rate.Limit {
+	return g.writeLimiter.Limit()
+}
+
+// SetQuota sets the aggregate quota of the Group, which is the number
+// of bytes (read and written together) the connections of the Group,
+// including the ones belonging to its subgroups, may transfer within
+// the period. When the period passes, the quota is reset. A zero period
+// means that the quota is never reset. To disable the quota, it can be set
+// to UnlimitedQuota, which is the default.
+//
+// Returns ErrInvalidQuota when bytes or period is negative.
+func (g *Group) SetQuota(bytes int64, period time.Duration) error {
+	if !validQuota(bytes, period) {
+		return ErrInvalidQuota
+	}
+
+	g.quota.set(g.limiter.clock.Now(), bytes, period)
+	return nil
+}
+
+// RemainingQuota returns the number of bytes the connections of the Group
+// may still transfer within the current period of the Group's quota.
+// Note that the quotas of the Group's ancestors still apply.
+func (g *Group) RemainingQuota() int64 {
+	return g.quota.remaining(g.limiter.clock.Now())
+}
+
+// TopUpQuota adds bytes to the current period of the Group's quota.
+// The bytes topped up expire along with the period.
+//
+// Returns ErrInvalidQuota when bytes is negative.
+func (g *Group) TopUpQuota(bytes int64) error {
+	if bytes < 0 {
+		return ErrInvalidQuota
+	}
+
+	g.quota.topUp(g.limiter.clock.Now(), bytes)
+	return nil
+}
+
+// Conns returns the connections of the Group, including the ones
+// belonging to its subgroups.
+func (g *Group) Conns() (ret []Conn) {
+	g.mu.Lock()
+	for conn := range g.conns {
+		ret = append(ret, conn)
+	}
+	groups := g.subgroups()
+	g.mu.Unlock()
+
+	for _, group := range groups {
+		ret = append(ret, group.Conns()...)
+	}
+	return
+}
+
+// Close closes the Group, along with all of its subgroups
+// and connections. The Group is detached from its parent.
+func (g *Group) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+
+	conns := make([]Conn, 0, len(g.conns))
+	for conn := range g.conns {
+		conns = append(conns, conn)
+	}
+	groups := g.subgroups()
+	g.mu.Unlock()
+
+	if g.parent != nil {
+		g.parent.deleteGroup(g)
+	}
+
+	var errs []error
+	for _, group := range groups {
+		errs = append(errs, group.Close())
+	}
+	for _, conn := range conns {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// subgroups returns a snapshot of the Group's subgroups.
+// The Group's mutex is expected to be held.
+func (g *Group) subgroups() []*Group {
+	ret := make([]*Group, 0, len(g.groups))
+	for group := range g.groups {
+		ret = append(ret, group)
+	}
+	return ret
+}
+
+func (g *Group) deleteConn(conn Conn) {
+	g.mu.Lock()
+	delete(g.conns, conn)
+	g.mu.Unlock()
+}
+
+func (g *Group) deleteGroup(group *Group) {
+	g.mu.Lock()
+	delete(g.groups, group)
+	g.mu.Unlock()
+}
+
+type GroupOption func(*Group)
+
+// WithGroupLimit is a Group option that sets the aggregate
+// bandwidth limit. See Group.SetLimit for more information.
+func WithGroupLimit(limit rate.Limit) GroupOption {
+	return func(g *Group) {
+		g.SetLimit(limit)
+	}
+}
+
+// WithGroupReadLimit is a Group option that sets the aggregate
+// read bandwidth limit. See Group.SetReadLimit for more information.
+func WithGroupReadLimit(limit rate.Limit) GroupOption {
+	return func(g *Group) {
+		g.SetReadLimit(limit)
+	}
+}
+
+// WithGroupWriteLimit is a Group option that sets the aggregate
+// write bandwidth limit. See Group.SetWriteLimit for more information.
+func WithGroupWriteLimit(limit rate.Limit) GroupOption {
+	return func(g *Group) {
+		g.SetWriteLimit(limit)
+	}
+}
+
+// WithGroupQuota is a Group option that sets the aggregate
+// quota. See Group.SetQuota for more information.
+func WithGroupQuota(bytes int64, period time.Duration) GroupOption {
+	return func(g *Group) {
+		g.SetQuota(bytes, period)
+	}
+}
+
+// WithGroupFairUsage is a Group option that applies the fair-usage policy
+// to the Group: once its connections have transferred the threshold number
+// of bytes within the current window, the Group's aggregate limit drops
+// to the lower tier, until the window rolls over. See WithFairUsage
+// for more information.
+func WithGroupFairUsage(policy FairUsage, observers ...TierObserver) GroupOption {
+	return func(g *Group) {
+		g.fairUsage = newFairUsage(policy, observers, g.limiter.burst,
+			g.limiter.clock.Now())
+		g.fairUsage.change.Group = g
+	}
+}
+
+// newGroup creates a Group charging its connections against the given
+// chain, extended with the Group's own limiters.
+func newGroup(l *Limiter, parent *Group, ch chain,
+	opts []GroupOption) (ret *Group) {
+	ret = &Group{
+		limiter:      l,
+		parent:       parent,
+		readLimiter:  l.burst.newLimiter(rate.Inf),
+		writeLimiter: l.burst.newLimiter(rate.Inf),
+		quota:        newQuota(UnlimitedQuota, 0, l.clock.Now()),
+		conns:        make(map[Conn]struct{}),
+		groups:       make(map[*Group]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	ret.chain = ch.withLimiters(ret.readLimiter, ret.writeLimiter).withQuota(ret.quota)
+	if ret.fairUsage != nil {
+		ret.chain = ret.chain.withFairUsage(ret.fairUsage)
+	}
+
+	if parent != nil {
+		parent.mu.Lock()
+		ret.closed = parent.closed
+		if !ret.closed {
+			parent.groups[ret] = struct{}{}
+		}
+		parent.mu.Unlock()
+	}
+	return
+}
@@ -0,0 +1,180 @@
+package tcplimit_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ksinica/tcplimit"
+	"github.com/ksinica/tcplimit/internal/pkg/mock"
+	"golang.org/x/time/rate"
+)
+
+func TestGroupAncestorLimit(t *testing.T) {
+	var slept time.Duration
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+			OnSleep: func(d time.Duration) {
+				slept += d
+				now = now.Add(d)
+			},
+		}),
+	)
+
+	tenant := limiter.NewGroup(tcplimit.WithGroupWriteLimit(rate.Limit(1024)))
+	user := tenant.NewGroup()
+
+	conn := user.LimitConn(mock.NewNoopConn())
+	defer conn.Close()
+
+	// The first kilobyte fits in the burst.
+	if _, err := conn.Write(make([]byte, 3*1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if slept != 2*time.Second {
+		t.Errorf("expected write to be throttled for %s, got %s", 2*time.Second, slept)
+	}
+}
+
+func TestGroupZeroAncestorLimit(t *testing.T) {
+	limiter := tcplimit.NewLimiter()
+
+	tenant := limiter.NewGroup(tcplimit.WithGroupLimit(rate.Limit(0)))
+	user := tenant.NewGroup(tcplimit.WithGroupLimit(rate.Limit(1024)))
+
+	conn := user.LimitConn(mock.NewNoopConn())
+	defer conn.Close()
+
+	_, err := conn.Write(make([]byte, 1024))
+	if !errors.Is(err, tcplimit.ErrUnfulfillableReservation) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrUnfulfillableReservation, err)
+	}
+}
+
+func TestGroupConnsAndClose(t *testing.T) {
+	limiter := tcplimit.NewLimiter()
+
+	tenant := limiter.NewGroup()
+	user := tenant.NewGroup()
+
+	tenant.LimitConn(mock.NewNoopConn())
+	user.LimitConn(mock.NewNoopConn())
+	other := limiter.NewGroup().LimitConn(mock.NewNoopConn())
+	defer other.Close()
+
+	if n := len(tenant.Conns()); n != 2 {
+		t.Errorf("expected %d connections, got %d", 2, n)
+	}
+	if n := len(user.Conns()); n != 1 {
+		t.Errorf("expected %d connections, got %d", 1, n)
+	}
+
+	if err := tenant.Close(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if n := len(tenant.Conns()); n != 0 {
+		t.Errorf("expected %d connections, got %d", 0, n)
+	}
+	if n := len(user.Conns()); n != 0 {
+		t.Errorf("expected %d connections, got %d", 0, n)
+	}
+
+	// Connections of a closed group are closed right away.
+	conn := user.LimitConn(mock.NewNoopConn())
+	if _, err := conn.Write([]byte{0}); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestGroupInvalidLimit(t *testing.T) {
+	group := tcplimit.NewLimiter().NewGroup()
+
+	err := group.SetLimit(rate.Limit(-1))
+	if !errors.Is(err, tcplimit.ErrInvalidLimit) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrInvalidLimit, err)
+	}
+}
+
+func TestGroupQuota(t *testing.T) {
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+		}),
+	)
+
+	tenant := limiter.NewGroup(tcplimit.WithGroupQuota(2*1024, 24*time.Hour))
+	user := tenant.NewGroup(tcplimit.WithGroupQuota(10*1024, 0))
+
+	first := user.LimitConn(mock.NewNoopConn())
+	defer first.Close()
+	second := tenant.LimitConn(mock.NewNoopConn())
+	defer second.Close()
+
+	if _, err := first.Write(make([]byte, 1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := second.Write(make([]byte, 1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// The tenant's quota is shared by the connections of the subgroups.
+	if _, err := first.Write(make([]byte, 1)); !errors.Is(err, tcplimit.ErrQuotaExceeded) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrQuotaExceeded, err)
+	}
+	if got := tenant.RemainingQuota(); got != 0 {
+		t.Errorf("expected no remaining quota, got %d", got)
+	}
+	if got := user.RemainingQuota(); got != 9*1024 {
+		t.Errorf("expected remaining quota %d, got %d", 9*1024, got)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if _, err := first.Write(make([]byte, 1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// The user's quota is never reset.
+	if got := user.RemainingQuota(); got != 8*1024 {
+		t.Errorf("expected remaining quota %d, got %d", 8*1024, got)
+	}
+}
+
+func TestGroupFairUsage(t *testing.T) {
+	var changes []tcplimit.TierChange
+	limiter := tcplimit.NewLimiter()
+
+	group := limiter.NewGroup(tcplimit.WithGroupFairUsage(
+		tcplimit.FairUsage{
+			Threshold: 1024,
+			Limit:     rate.Limit(0),
+		},
+		func(change tcplimit.TierChange) {
+			changes = append(changes, change)
+		},
+	))
+
+	first := group.LimitConn(mock.NewNoopConn())
+	defer first.Close()
+	second := group.LimitConn(mock.NewNoopConn())
+	defer second.Close()
+
+	if _, err := first.Write(make([]byte, 1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(changes) != 1 || !changes[0].Downgraded || changes[0].Group != group {
+		t.Fatalf("expected the group to be downgraded, got %+v", changes)
+	}
+
+	// The lower tier applies to all of the Group's connections.
+	_, err := second.Write(make([]byte, 1024))
+	if !errors.Is(err, tcplimit.ErrUnfulfillableReservation) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrUnfulfillableReservation, err)
+	}
+}
@@ -0,0 +1,183 @@
+package tcplimit
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// requestAddr is the remote address of an HTTP request.
+type requestAddr string
+
+func (requestAddr) Network() string {
+	return "tcp"
+}
+
+func (a requestAddr) String() string {
+	return string(a)
+}
+
+// requestBody is a bandwidth-limited body of an HTTP request.
+type requestBody struct {
+	io.ReadCloser
+
+	r    *http.Request
+	conn Conn
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	return b.conn.ReadContext(b.r.Context(), p)
+}
+
+// responseWriter is a bandwidth-limited writer of an HTTP response.
+type responseWriter struct {
+	http.ResponseWriter
+
+	r    *http.Request
+	conn Conn
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	return w.conn.WriteContext(w.r.Context(), p)
+}
+
+func (w *responseWriter) Flush() {
+	w.FlushError()
+}
+
+// FlushError flushes the response, returning http.ErrNotSupported, when
+// the underlying http.ResponseWriter cannot flush.
+func (w *responseWriter) FlushError() error {
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack takes over the underlying connection, which is no longer limited
+// by the handler.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// SetWriteDeadline sets the write deadline of the underlying
+// http.ResponseWriter, which applies to the waits for the bandwidth
+// as well.
+func (w *responseWriter) SetWriteDeadline(t time.Time) error {
+	if err := http.NewResponseController(w.ResponseWriter).SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return w.conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying
+// http.ResponseWriter, which applies to the waits for the bandwidth
+// as well.
+func (w *responseWriter) SetReadDeadline(t time.Time) error {
+	if err := http.NewResponseController(w.ResponseWriter).SetReadDeadline(t); err != nil {
+		return err
+	}
+	return w.conn.SetReadDeadline(t)
+}
+
+// Unwrap returns the underlying http.ResponseWriter,
+// for http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type limitedHandler struct {
+	next    http.Handler
+	limiter *Limiter
+	group   func(r *http.Request) *Group
+	limits  func(r *http.Request, c Conn)
+}
+
+func (h *limitedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The server takes care of closing the body and the response.
+	adapter := &streamAdapter{
+		r:      http.NoBody,
+		w:      w,
+		remote: requestAddr(r.RemoteAddr),
+	}
+	if r.Body != nil {
+		adapter.r = r.Body
+	}
+
+	var group *Group
+	if h.group != nil {
+		group = h.group(r)
+	}
+	var conn Conn
+	if group != nil {
+		conn = group.LimitConn(adapter)
+	} else {
+		conn = h.limiter.LimitConn(adapter)
+	}
+	defer conn.Close()
+
+	if h.limits != nil {
+		h.limits(r, conn)
+	}
+
+	if r.Body != nil {
+		r2 := *r
+		r2.Body = &requestBody{ReadCloser: r.Body, r: r, conn: conn}
+		r = &r2
+	}
+	h.next.ServeHTTP(&responseWriter{ResponseWriter: w, r: r, conn: conn}, r)
+}
+
+type HandlerOption func(*limitedHandler)
+
+// WithHandlerLimiter is a handler option that makes the handler use
+// the given Limiter, instead of a new one.
+func WithHandlerLimiter(limiter *Limiter) HandlerOption {
+	return func(h *limitedHandler) {
+		h.limiter = limiter
+	}
+}
+
+// WithRequestGroup is a handler option that selects the Group
+// of the requests, e.g. by their route, so that they share the Group's
+// aggregate limits. The requests for which the callback returns nil
+// are bounded by the Limiter's global limits only.
+func WithRequestGroup(group func(r *http.Request) *Group) HandlerOption {
+	return func(h *limitedHandler) {
+		h.group = group
+	}
+}
+
+// WithRequestLimits is a handler option that sets up the own limits
+// of the requests, e.g. by their route, with the Conn representing
+// the request. The Conn's read direction is the request's body, while
+// its write direction is the response.
+func WithRequestLimits(limits func(r *http.Request, c Conn)) HandlerOption {
+	return func(h *limitedHandler) {
+		h.limits = limits
+	}
+}
+
+// NewHandler wraps the HTTP handler, so that every request's body
+// and response are limited, as if each request was a connection
+// of the Limiter. Unlike the connections accepted by LimitedListener,
+// the requests can be given their own limits, even when they share
+// a keep-alive connection. The waits for the bandwidth respect
+// the request's context.
+//
+// The response writer passed to the handler supports http.Flusher,
+// http.Hijacker and http.ResponseController, as long as the underlying
+// one does, but the hijacked connections are no longer limited.
+func NewHandler(next http.Handler, opts ...HandlerOption) http.Handler {
+	ret := &limitedHandler{
+		next: next,
+	}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	if ret.limiter == nil {
+		ret.limiter = NewLimiter()
+	}
+	return ret
+}
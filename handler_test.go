@@ -0,0 +1,120 @@
+package tcplimit_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ksinica/tcplimit"
+	"github.com/ksinica/tcplimit/internal/pkg/mock"
+	"golang.org/x/time/rate"
+)
+
+func TestHandlerRequestLimits(t *testing.T) {
+	var slept time.Duration
+	now := time.Now()
+	handler := tcplimit.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := w.Write(make([]byte, 2048)); err != nil {
+				t.Error("unexpected error:", err)
+			}
+		}),
+		tcplimit.WithHandlerLimiter(tcplimit.NewLimiter(
+			tcplimit.WithClock(&mock.Clock{
+				OnNow: func() time.Time {
+					return now
+				},
+				OnSleep: func(d time.Duration) {
+					slept += d
+					now = now.Add(d)
+				},
+			}),
+		)),
+		tcplimit.WithRequestLimits(func(r *http.Request, c tcplimit.Conn) {
+			if r.URL.Path == "/download" {
+				c.SetWriteLimit(rate.Limit(1024))
+			}
+		}),
+	)
+
+	for _, test := range []struct {
+		path     string
+		expected time.Duration
+	}{
+		{"/api", 0},
+		{"/download", time.Second},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			slept = 0
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			if w.Body.Len() != 2048 {
+				t.Errorf("expected %d bytes of response, got %d", 2048, w.Body.Len())
+			}
+			if slept != test.expected {
+				t.Errorf("expected response to be throttled for %s, got %s", test.expected, slept)
+			}
+		})
+	}
+}
+
+func TestHandlerResponseController(t *testing.T) {
+	handler := tcplimit.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(w)
+			if err := rc.Flush(); err != nil {
+				t.Error("unexpected error:", err)
+			}
+			if _, _, err := rc.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+				t.Errorf("expected %v, got %v", http.ErrNotSupported, err)
+			}
+			if _, ok := w.(http.Flusher); !ok {
+				t.Error("expected the response writer to be a flusher")
+			}
+		}),
+	)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !w.Flushed {
+		t.Error("expected the response to be flushed")
+	}
+}
+
+func TestHandlerResponseControllerDeadline(t *testing.T) {
+	errs := make(chan error, 1)
+	server := httptest.NewServer(tcplimit.NewHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(w)
+			if err := rc.SetWriteDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+				errs <- err
+				return
+			}
+			// The throttled write would take seconds.
+			_, err := w.Write(make([]byte, 4096))
+			errs <- err
+		}),
+		tcplimit.WithRequestLimits(func(r *http.Request, c tcplimit.Conn) {
+			c.SetWriteLimit(rate.Limit(1024))
+		}),
+	))
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("expected %v, got %v", os.ErrDeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the write to hit the deadline")
+	}
+}
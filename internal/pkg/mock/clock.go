@@ -5,6 +5,9 @@ import "time"
 type Clock struct {
 	OnNow   func() time.Time
 	OnSleep func(time.Duration)
+	// OnNewTimer is called to create a timer. When not set, the timer
+	// fires immediately, after passing its duration to Sleep.
+	OnNewTimer func(time.Duration) (<-chan time.Time, func() bool)
 }
 
 func (c *Clock) Now() (ret time.Time) {
@@ -19,3 +22,15 @@ func (c *Clock) Sleep(d time.Duration) {
 		c.OnSleep(d)
 	}
 }
+
+func (c *Clock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	if c.OnNewTimer != nil {
+		return c.OnNewTimer(d)
+	}
+
+	c.Sleep(d)
+
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch, func() bool { return false }
+}
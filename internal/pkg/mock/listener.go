@@ -0,0 +1,49 @@
+package mock
+
+import (
+	"net"
+	"sync"
+)
+
+// Listener is net.Listener accepting the connections passed to Dial.
+type Listener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Dial makes the listener accept the connection.
+func (l *Listener) Dial(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (*Listener) Addr() net.Addr {
+	return nil
+}
+
+// NewListener returns a Listener accepting no connections until dialed.
+func NewListener() *Listener {
+	return &Listener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
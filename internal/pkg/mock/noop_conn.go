@@ -3,11 +3,13 @@ package mock
 import (
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 type noopConn struct {
-	q chan struct{}
+	q    chan struct{}
+	once sync.Once
 }
 
 func (c *noopConn) Write(p []byte) (int, error) {
@@ -28,9 +30,13 @@ func (c *noopConn) Read(p []byte) (int, error) {
 	}
 }
 
-func (c *noopConn) Close() error {
-	close(c.q)
-	return nil
+func (c *noopConn) Close() (err error) {
+	err = net.ErrClosed
+	c.once.Do(func() {
+		close(c.q)
+		err = nil
+	})
+	return
 }
 
 func (*noopConn) LocalAddr() net.Addr {
@@ -0,0 +1,44 @@
+package mock
+
+import (
+	"net"
+	"time"
+)
+
+type noopPacketConn struct {
+	conn net.Conn
+}
+
+func (c *noopPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.conn.Read(p)
+	return n, nil, err
+}
+
+func (c *noopPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.conn.Write(p)
+}
+
+func (c *noopPacketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (*noopPacketConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (*noopPacketConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (*noopPacketConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (*noopPacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// NewNoopPacketConn returns net.PacketConn that basically does nothing.
+func NewNoopPacketConn() net.PacketConn {
+	return &noopPacketConn{conn: NewNoopConn()}
+}
@@ -0,0 +1,17 @@
+package mock
+
+import "net"
+
+type remoteAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// NewRemoteAddrConn returns net.Conn with the given remote address.
+func NewRemoteAddrConn(conn net.Conn, addr net.Addr) net.Conn {
+	return &remoteAddrConn{Conn: conn, addr: addr}
+}
@@ -0,0 +1,17 @@
+package mock
+
+import "net"
+
+type shortReadConn struct {
+	net.Conn
+	n int
+}
+
+func (c *shortReadConn) Read(p []byte) (int, error) {
+	return c.Conn.Read(p[:min(c.n, len(p))])
+}
+
+// NewShortReadConn returns net.Conn that reads at most n bytes at once.
+func NewShortReadConn(conn net.Conn, n int) net.Conn {
+	return &shortReadConn{Conn: conn, n: n}
+}
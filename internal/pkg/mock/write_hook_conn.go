@@ -0,0 +1,18 @@
+package mock
+
+import "net"
+
+type writeHookConn struct {
+	net.Conn
+	onWrite func([]byte)
+}
+
+func (c *writeHookConn) Write(p []byte) (int, error) {
+	c.onWrite(p)
+	return c.Conn.Write(p)
+}
+
+// NewWriteHookConn returns net.Conn that calls onWrite before every write.
+func NewWriteHookConn(conn net.Conn, onWrite func([]byte)) net.Conn {
+	return &writeHookConn{Conn: conn, onWrite: onWrite}
+}
@@ -0,0 +1,309 @@
+package tcplimit
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultKeyTTL = time.Minute
+)
+
+// KeyFunc derives a key from the connection, telling which of the
+// KeyedLimiter's buckets the connection is charged against.
+type KeyFunc func(conn net.Conn) string
+
+// RemoteIP is a KeyFunc grouping the connections by their remote IP address.
+// Addresses that are not IP addresses are used as keys verbatim.
+func RemoteIP(conn net.Conn) string {
+	ip, ok := remoteIP(conn)
+	if !ok {
+		return remoteAddr(conn)
+	}
+	return ip.String()
+}
+
+// RemotePrefix returns a KeyFunc grouping the connections by the network
+// prefix of their remote address, e.g. /24 for IPv4 and /64 for IPv6.
+// Addresses that are not IP addresses are used as keys verbatim.
+func RemotePrefix(v4Bits, v6Bits int) KeyFunc {
+	return func(conn net.Conn) string {
+		ip, ok := remoteIP(conn)
+		if !ok {
+			return remoteAddr(conn)
+		}
+
+		bits := v6Bits
+		if ip.Is4() {
+			bits = v4Bits
+		}
+
+		prefix, err := ip.Prefix(bits)
+		if err != nil {
+			return remoteAddr(conn)
+		}
+		return prefix.String()
+	}
+}
+
+func remoteIP(conn net.Conn) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(remoteAddr(conn))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+func remoteAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// KeyedLimiter groups the connections by a key (e.g. the remote IP address),
+// giving every key its own aggregate bucket. The buckets sit between
+// the limits of the KeyedLimiter's parent (a Limiter or a Group) and
+// the local limits, so a single client cannot get around the per-connection
+// limit by opening more connections.
+//
+// Keys with no connections are evicted after a TTL, so that the memory
+// stays bounded. Until then, new connections with the same key continue
+// to use the bucket of the previous ones.
+//
+// KeyedLimiter's methods can be used concurrently.
+type KeyedLimiter struct {
+	newGroup   func(opts ...GroupOption) *Group
+	clock      Clock
+	key        KeyFunc
+	ttl        time.Duration
+	mu         sync.Mutex
+	readLimit  rate.Limit
+	writeLimit rate.Limit
+	groups     map[string]*keyedGroup
+	lastSweep  time.Time
+}
+
+type keyedGroup struct {
+	*Group
+
+	conns     int
+	idleSince time.Time
+}
+
+// LimitConn wraps the given connection into a bandwidth-limited connection,
+// charged against the bucket of the connection's key.
+func (k *KeyedLimiter) LimitConn(conn net.Conn) Conn {
+	return k.limitConn(conn, k.key(conn))
+}
+
+// limitConn acts like LimitConn, charging the connection against
+// the bucket of the given key.
+func (k *KeyedLimiter) limitConn(conn net.Conn, key string) Conn {
+	k.mu.Lock()
+	now := k.clock.Now()
+	k.sweep(now)
+
+	group, ok := k.groups[key]
+	if !ok {
+		group = &keyedGroup{
+			Group: k.newGroup(
+				WithGroupReadLimit(k.readLimit),
+				WithGroupWriteLimit(k.writeLimit),
+			),
+		}
+		k.groups[key] = group
+	}
+	group.conns++
+	k.mu.Unlock()
+
+	return group.limitConn(conn, func(Conn) {
+		k.release(key)
+	})
+}
+
+// SetLimit sets the aggregate limit of every key to Limit bytes per second
+// for both read and write directions.
+//
+// Returns ErrInvalidLimit when Limit is negative.
+func (k *KeyedLimiter) SetLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
+	}
+
+	k.mu.Lock()
+	k.readLimit = limit
+	k.writeLimit = limit
+	for _, group := range k.groups {
+		group.SetLimit(limit)
+	}
+	k.mu.Unlock()
+
+	return nil
+}
+
+// Limit returns the current per-key Limit. When read and write limits
+// differ, the lower of them is returned.
+func (k *KeyedLimiter) Limit() rate.Limit {
+	return min(k.ReadLimit(), k.WriteLimit())
+}
+
+// SetReadLimit sets the aggregate limit of every key for the read direction
+// only. See SetLimit for more information.
+func (k *KeyedLimiter) SetReadLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
+	}
+
+	k.mu.Lock()
+	k.readLimit = limit
+	for _, group := range k.groups {
+		group.SetReadLimit(limit)
+	}
+	k.mu.Unlock()
+
+	return nil
+}
+
+// ReadLimit returns the current per-key read Limit.
+func (k *KeyedLimiter) ReadLimit() (ret rate.Limit) {
+	k.mu.Lock()
+	ret = k.readLimit
+	k.mu.Unlock()
+	return
+}
+
+// SetWriteLimit sets the aggregate limit of every key for the write direction
+// only. See SetLimit for more information.
+func (k *KeyedLimiter) SetWriteLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
+	}
+
+	k.mu.Lock()
+	k.writeLimit = limit
+	for _, group := range k.groups {
+		group.SetWriteLimit(limit)
+	}
+	k.mu.Unlock()
+
+	return nil
+}
+
+// WriteLimit returns the current per-key write Limit.
+func (k *KeyedLimiter) WriteLimit() (ret rate.Limit) {
+	k.mu.Lock()
+	ret = k.writeLimit
+	k.mu.Unlock()
+	return
+}
+
+// Keys returns the keys currently tracked by the KeyedLimiter,
+// including the idle ones, which are not evicted yet.
+func (k *KeyedLimiter) Keys() (ret []string) {
+	k.mu.Lock()
+	k.sweep(k.clock.Now())
+	for key := range k.groups {
+		ret = append(ret, key)
+	}
+	k.mu.Unlock()
+	return
+}
+
+func (k *KeyedLimiter) release(key string) {
+	k.mu.Lock()
+	if group, ok := k.groups[key]; ok {
+		group.conns--
+		if group.conns == 0 {
+			group.idleSince = k.clock.Now()
+		}
+	}
+	k.mu.Unlock()
+}
+
+// sweep evicts the keys, which have been idle for at least the TTL.
+// To keep LimitConn cheap, it does so at most once per TTL, so the keys
+// may linger for up to twice the TTL. The mutex is expected to be held.
+func (k *KeyedLimiter) sweep(now time.Time) {
+	if now.Sub(k.lastSweep) < k.ttl {
+		return
+	}
+	k.lastSweep = now
+
+	for key, group := range k.groups {
+		if group.conns == 0 && now.Sub(group.idleSince) >= k.ttl {
+			delete(k.groups, key)
+			group.Close()
+		}
+	}
+}
+
+type KeyedLimiterOption func(*KeyedLimiter)
+
+// WithKeyLimit is a KeyedLimiter option that sets the per-key aggregate
+// bandwidth limit. See KeyedLimiter.SetLimit for more information.
+func WithKeyLimit(limit rate.Limit) KeyedLimiterOption {
+	return func(k *KeyedLimiter) {
+		k.readLimit = limit
+		k.writeLimit = limit
+	}
+}
+
+// WithKeyReadLimit is a KeyedLimiter option that sets the per-key aggregate
+// read bandwidth limit. See KeyedLimiter.SetReadLimit for more information.
+func WithKeyReadLimit(limit rate.Limit) KeyedLimiterOption {
+	return func(k *KeyedLimiter) {
+		k.readLimit = limit
+	}
+}
+
+// WithKeyWriteLimit is a KeyedLimiter option that sets the per-key aggregate
+// write bandwidth limit. See KeyedLimiter.SetWriteLimit for more information.
+func WithKeyWriteLimit(limit rate.Limit) KeyedLimiterOption {
+	return func(k *KeyedLimiter) {
+		k.writeLimit = limit
+	}
+}
+
+// WithKeyTTL is a KeyedLimiter option that sets for how long the keys
+// with no connections are kept, before being evicted. By default,
+// it's one minute.
+func WithKeyTTL(ttl time.Duration) KeyedLimiterOption {
+	return func(k *KeyedLimiter) {
+		k.ttl = ttl
+	}
+}
+
+// NewKeyedLimiter creates a new KeyedLimiter, grouping the connections
+// by the key function. The keys are bounded by the global limits.
+func (l *Limiter) NewKeyedLimiter(key KeyFunc, opts ...KeyedLimiterOption) *KeyedLimiter {
+	return newKeyedLimiter(l.NewGroup, l.clock, key, opts)
+}
+
+// NewKeyedLimiter creates a new KeyedLimiter, grouping the connections
+// by the key function. The keys are bounded by the limits of the Group.
+func (g *Group) NewKeyedLimiter(key KeyFunc, opts ...KeyedLimiterOption) *KeyedLimiter {
+	return newKeyedLimiter(g.NewGroup, g.limiter.clock, key, opts)
+}
+
+func newKeyedLimiter(newGroup func(opts ...GroupOption) *Group, clock Clock,
+	key KeyFunc, opts []KeyedLimiterOption) (ret *KeyedLimiter) {
+	ret = &KeyedLimiter{
+		newGroup:   newGroup,
+		clock:      clock,
+		key:        key,
+		ttl:        defaultKeyTTL,
+		readLimit:  rate.Inf,
+		writeLimit: rate.Inf,
+		groups:     make(map[string]*keyedGroup),
+	}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return
+}
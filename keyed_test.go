@@ -0,0 +1,129 @@
+package tcplimit_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ksinica/tcplimit"
+	"github.com/ksinica/tcplimit/internal/pkg/mock"
+	"golang.org/x/time/rate"
+)
+
+func newRemoteAddrConn(t *testing.T, addr string) net.Conn {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return mock.NewRemoteAddrConn(mock.NewNoopConn(), tcpAddr)
+}
+
+func TestKeyFuncs(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		key      tcplimit.KeyFunc
+		addr     string
+		expected string
+	}{
+		{
+			name:     "ipv4",
+			key:      tcplimit.RemoteIP,
+			addr:     "192.0.2.1:1234",
+			expected: "192.0.2.1",
+		},
+		{
+			name:     "ipv6",
+			key:      tcplimit.RemoteIP,
+			addr:     "[2001:db8::1]:1234",
+			expected: "2001:db8::1",
+		},
+		{
+			name:     "ipv4 prefix",
+			key:      tcplimit.RemotePrefix(24, 64),
+			addr:     "192.0.2.1:1234",
+			expected: "192.0.2.0/24",
+		},
+		{
+			name:     "ipv6 prefix",
+			key:      tcplimit.RemotePrefix(24, 64),
+			addr:     "[2001:db8:1:2:3::1]:1234",
+			expected: "2001:db8:1:2::/64",
+		},
+		{
+			name:     "ipv4-mapped ipv6 prefix",
+			key:      tcplimit.RemotePrefix(24, 64),
+			addr:     "[::ffff:192.0.2.1]:1234",
+			expected: "192.0.2.0/24",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.key(newRemoteAddrConn(t, test.addr)); got != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestKeyedLimiterSharedBucket(t *testing.T) {
+	var slept time.Duration
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+			OnSleep: func(d time.Duration) {
+				slept += d
+				now = now.Add(d)
+			},
+		}),
+	)
+
+	keyed := limiter.NewKeyedLimiter(
+		tcplimit.RemoteIP,
+		tcplimit.WithKeyWriteLimit(rate.Limit(1024)),
+	)
+
+	for _, addr := range []string{"192.0.2.1:1", "192.0.2.2:1", "192.0.2.1:2"} {
+		conn := keyed.LimitConn(newRemoteAddrConn(t, addr))
+		defer conn.Close()
+
+		if _, err := conn.Write(make([]byte, 1024)); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	// Only the second connection from 192.0.2.1 should wait
+	// for the bucket drained by the first one.
+	if slept != time.Second {
+		t.Errorf("expected writes to be throttled for %s, got %s", time.Second, slept)
+	}
+}
+
+func TestKeyedLimiterEviction(t *testing.T) {
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+		}),
+	)
+
+	keyed := limiter.NewKeyedLimiter(
+		tcplimit.RemoteIP,
+		tcplimit.WithKeyTTL(time.Minute),
+	)
+
+	idle := keyed.LimitConn(newRemoteAddrConn(t, "192.0.2.1:1"))
+	active := keyed.LimitConn(newRemoteAddrConn(t, "192.0.2.2:1"))
+	defer active.Close()
+
+	idle.Close()
+	now = now.Add(time.Minute)
+
+	if got, expected := keyed.Keys(), []string{"192.0.2.2"}; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
@@ -1,8 +1,13 @@
 package tcplimit
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"net"
+	"slices"
 	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 )
@@ -13,36 +18,138 @@ import (
 // independently of their own limits.
 // 2. local - a limit specified per connection.
 //
+// Both of the limits are further split by direction: read (ingress)
+// and write (egress) traffic is shaped independently, so that an upload
+// does not starve a download on the same connection.
+//
 // Limiter provides a convenient interface for setting both of the limits,
 // giving the ability to shape bandwidth during runtime.
 //
 // Limiter's methods can be used concurrently.
 type Limiter struct {
-	globalLimiter *rate.Limiter
-	clock         Clock
-	mu            sync.Mutex
-	localLimit    rate.Limit
-	conns         map[Conn]struct{}
+	globalReadLimiter  *rate.Limiter
+	globalWriteLimiter *rate.Limiter
+	// root is the root of the chains, which has no limiters, when
+	// the schedulers take care of the global limiters.
+	root            chain
+	fair            bool
+	readScheduler   *scheduler
+	writeScheduler  *scheduler
+	burst           burstPolicy
+	clock           Clock
+	mu              sync.Mutex
+	localReadLimit  rate.Limit
+	localWriteLimit rate.Limit
+	// localQuota and localQuotaPeriod are the parameters
+	// of the connections' own quotas.
+	localQuota       int64
+	localQuotaPeriod time.Duration
+	// fairUsage is the fair-usage policy of the connections, if any.
+	fairUsage     *FairUsage
+	tierObservers []TierObserver
+	// credits configure the burstable mode of the connections, if any.
+	credits *Credits
+	// netem are the parameters of the emulated link, if any.
+	netem netem
+	// faults are the faults injected into the connections.
+	faults Faults
+	// schedule is the Schedule set by WithSchedule, while scheduleStop
+	// and scheduleDone control the goroutine running the current one.
+	schedule     *Schedule
+	scheduleMu   sync.Mutex
+	scheduleStop chan struct{}
+	scheduleDone chan struct{}
+	// globalRamp and localRamp are the ramps in progress, if any.
+	rampMu     sync.Mutex
+	globalRamp *ramp
+	localRamp  *ramp
+	conns      map[*conn]struct{}
+	totalConns int64
+	stats      counters
+	// shutdown tells whether the Limiter refuses new connections, while
+	// drained gets closed once no connections are left.
+	shutdown bool
+	drained  chan struct{}
 }
 
 // LimitConn wraps the given connection into a bandwidth-limited connection.
 func (l *Limiter) LimitConn(conn net.Conn) Conn {
+	return l.limitConn(conn, l.root, l.deleteConn)
+}
+
+// limitConn wraps the connection, charging it against the given chain
+// (besides its own local limiters).
+func (l *Limiter) limitConn(conn net.Conn, ch chain, close func(Conn)) Conn {
+	now := l.clock.Now()
 	l.mu.Lock()
+	own := newQuota(l.localQuota, l.localQuotaPeriod, now)
+	ch = ch.withQuota(own)
+	var usage *fairUsage
+	if l.fairUsage != nil {
+		usage = newFairUsage(*l.fairUsage, l.tierObservers, l.burst, now)
+		ch = ch.withFairUsage(usage)
+	}
+	if l.credits != nil {
+		ch = ch.withLimiters(l.credits.newLimiter(now), l.credits.newLimiter(now))
+	}
 	ret := wrapConn(
 		conn,
-		l.globalLimiter,
-		rate.NewLimiter(l.localLimit, chunkSize),
+		buckets{
+			shared: ch.read,
+			local:  l.burst.newLimiter(l.localReadLimit),
+			sched:  l.readScheduler,
+			flow:   newFlow(),
+			quotas: ch.quotas,
+			usages: ch.usages,
+		},
+		buckets{
+			shared: ch.write,
+			local:  l.burst.newLimiter(l.localWriteLimit),
+			sched:  l.writeScheduler,
+			flow:   newFlow(),
+			quotas: ch.quotas,
+			usages: ch.usages,
+		},
+		l.burst,
 		l.clock,
-		l.deleteConn,
+		&l.stats,
+		close,
 	)
+	ret.reset = l.resetConnLimits
+	ret.quota = own
+	// The ID is known upfront, as it seeds the faults.
+	l.totalConns++
+	ret.id = uint64(l.totalConns)
+	if l.netem.enabled() {
+		ret.link = newLink(conn, l.clock, l.netem)
+	}
+	if l.faults != (Faults{}) {
+		ret.injectFaults(l.faults)
+	}
+	if usage != nil {
+		usage.change.Conn = ret.outer
+	}
+	if l.shutdown {
+		l.mu.Unlock()
+		ret.Close()
+		return ret.outer
+	}
 	l.conns[ret] = struct{}{}
 	l.mu.Unlock()
-	return ret
+	return ret.outer
+}
+
+// NewGroup creates a new Group of connections, bounded by its own aggregate
+// limits, as well as the global ones.
+func (l *Limiter) NewGroup(opts ...GroupOption) *Group {
+	return newGroup(l, nil, l.root, opts)
 }
 
-// SetGlobalLimit sets the global limit to Limit bytes per second.
-// The global limit is a cumulative bandwidth limit for all connections wrapped
-// by the Limiter. It takes precedence over the connection's local limit.
+// SetGlobalLimit sets the global limit to Limit bytes per second
+// for both read and write directions. The global limit is a cumulative
+// bandwidth limit for all connections wrapped by the Limiter. It takes
+// precedence over the connection's local limit. It cancels the global
+// limit's ramp in progress, if any.
 //
 // Returns ErrInvalidLimit when Limit is negative.
 func (l *Limiter) SetGlobalLimit(limit rate.Limit) error {
@@ -50,22 +157,62 @@ func (l *Limiter) SetGlobalLimit(limit rate.Limit) error {
 		return ErrInvalidLimit
 	}
 
-	l.globalLimiter.SetLimitAt(l.clock.Now(), limit)
+	l.stopRamp(&l.globalRamp)
+	l.setGlobalLimit(l.globalReadLimiter, l.readScheduler, limit)
+	l.setGlobalLimit(l.globalWriteLimiter, l.writeScheduler, limit)
 	return nil
 }
 
-// GlobalLimit resturn the current global Limit.
+// GlobalLimit resturn the current global Limit. When read and write limits
+// differ, the lower of them is returned.
 func (l *Limiter) GlobalLimit() rate.Limit {
-	return l.globalLimiter.Limit()
+	return min(l.GlobalReadLimit(), l.GlobalWriteLimit())
+}
+
+// SetGlobalReadLimit sets the global limit for the read direction only.
+// See SetGlobalLimit for more information.
+func (l *Limiter) SetGlobalReadLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
+	}
+
+	l.stopRamp(&l.globalRamp)
+	l.setGlobalLimit(l.globalReadLimiter, l.readScheduler, limit)
+	return nil
+}
+
+// GlobalReadLimit returns the current global read Limit.
+func (l *Limiter) GlobalReadLimit() rate.Limit {
+	return l.globalReadLimiter.Limit()
+}
+
+// SetGlobalWriteLimit sets the global limit for the write direction only.
+// See SetGlobalLimit for more information.
+func (l *Limiter) SetGlobalWriteLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
+	}
+
+	l.stopRamp(&l.globalRamp)
+	l.setGlobalLimit(l.globalWriteLimiter, l.writeScheduler, limit)
+	return nil
+}
+
+// GlobalWriteLimit returns the current global write Limit.
+func (l *Limiter) GlobalWriteLimit() rate.Limit {
+	return l.globalWriteLimiter.Limit()
 }
 
 // SetLocalLimit sets the per-connection Limit (bytes per second)
-// for all the connections wrapped by the Limiter. Even if the per-connection
-// limit could be set to be greater than the global limit, the latter
-// takes precedence.
+// for both read and write directions of all the connections wrapped
+// by the Limiter. Even if the per-connection limit could be set to be
+// greater than the global limit, the latter takes precedence.
 //
 // There's a guarantee that all of the connections shaped by the Limiter
-// have a new local limit set when this method finishes execution.
+// have a new local limit set when this method finishes execution, except
+// for the ones with their limits overridden by Conn.SetLimit (until they
+// call Conn.ResetLimit). It cancels the local limit's ramp in progress,
+// if any.
 //
 // Returns ErrInvalidLimit when Limit is negative.
 func (l *Limiter) SetLocalLimit(limit rate.Limit) error {
@@ -73,27 +220,283 @@ func (l *Limiter) SetLocalLimit(limit rate.Limit) error {
 		return ErrInvalidLimit
 	}
 
+	l.stopRamp(&l.localRamp)
 	l.mu.Lock()
-	l.localLimit = limit
+	l.localReadLimit = limit
+	l.localWriteLimit = limit
 	for conn := range l.conns {
-		conn.SetLimit(limit)
+		conn.inheritReadLimit(limit)
+		conn.inheritWriteLimit(limit)
 	}
 	l.mu.Unlock()
 
 	return nil
 }
 
-// LocalLimit returns the current local Limit.
-func (l *Limiter) LocalLimit() (ret rate.Limit) {
+// LocalLimit returns the current local Limit. When read and write limits
+// differ, the lower of them is returned.
+func (l *Limiter) LocalLimit() rate.Limit {
+	return min(l.LocalReadLimit(), l.LocalWriteLimit())
+}
+
+// SetLocalReadLimit sets the per-connection Limit for the read direction
+// only. See SetLocalLimit for more information.
+func (l *Limiter) SetLocalReadLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
+	}
+
+	l.stopRamp(&l.localRamp)
+	l.setLocalReadLimit(limit)
+	return nil
+}
+
+func (l *Limiter) setLocalReadLimit(limit rate.Limit) {
 	l.mu.Lock()
-	ret = l.localLimit
+	l.localReadLimit = limit
+	for conn := range l.conns {
+		conn.inheritReadLimit(limit)
+	}
+	l.mu.Unlock()
+}
+
+// LocalReadLimit returns the current local read Limit.
+func (l *Limiter) LocalReadLimit() (ret rate.Limit) {
+	l.mu.Lock()
+	ret = l.localReadLimit
 	l.mu.Unlock()
 	return
 }
 
-func (l *Limiter) deleteConn(conn Conn) {
+// SetLocalWriteLimit sets the per-connection Limit for the write direction
+// only. See SetLocalLimit for more information.
+func (l *Limiter) SetLocalWriteLimit(limit rate.Limit) error {
+	if limit < 0 {
+		return ErrInvalidLimit
+	}
+
+	l.stopRamp(&l.localRamp)
+	l.setLocalWriteLimit(limit)
+	return nil
+}
+
+func (l *Limiter) setLocalWriteLimit(limit rate.Limit) {
+	l.mu.Lock()
+	l.localWriteLimit = limit
+	for conn := range l.conns {
+		conn.inheritWriteLimit(limit)
+	}
+	l.mu.Unlock()
+}
+
+// LocalWriteLimit returns the current local write Limit.
+func (l *Limiter) LocalWriteLimit() (ret rate.Limit) {
 	l.mu.Lock()
-	delete(l.conns, conn)
+	ret = l.localWriteLimit
+	l.mu.Unlock()
+	return
+}
+
+// SetLocalQuota sets the per-connection quota, which is the number of bytes
+// (read and written together) each of the connections wrapped by
+// the Limiter may transfer within the period. When the period passes,
+// the quota is reset. A zero period means that the quota is never reset.
+// To disable the quota, it can be set to UnlimitedQuota.
+//
+// The quota applies to the existing connections as well, keeping
+// the bytes they have transferred so far. A new period starts, when
+// the period is changed.
+//
+// Returns ErrInvalidQuota when bytes or period is negative.
+func (l *Limiter) SetLocalQuota(bytes int64, period time.Duration) error {
+	if !validQuota(bytes, period) {
+		return ErrInvalidQuota
+	}
+
+	now := l.clock.Now()
+	l.mu.Lock()
+	l.localQuota = bytes
+	l.localQuotaPeriod = period
+	for conn := range l.conns {
+		conn.quota.set(now, bytes, period)
+	}
+	l.mu.Unlock()
+
+	return nil
+}
+
+// LocalQuota returns the current per-connection quota and its period.
+func (l *Limiter) LocalQuota() (bytes int64, period time.Duration) {
+	l.mu.Lock()
+	bytes, period = l.localQuota, l.localQuotaPeriod
+	l.mu.Unlock()
+	return
+}
+
+// RemainingQuota returns the number of bytes the connection may still
+// transfer within the current period of its own quota. Note that
+// the quotas of the groups the connection belongs to still apply.
+//
+// Returns zero for connections not wrapped by a Limiter.
+func (l *Limiter) RemainingQuota(c Conn) int64 {
+	conn, ok := innerConn(c)
+	if !ok || conn.quota == nil {
+		return 0
+	}
+	return conn.quota.remaining(l.clock.Now())
+}
+
+// TopUpQuota adds bytes to the current period of the connection's own
+// quota. The bytes topped up expire along with the period.
+//
+// Returns ErrInvalidQuota when bytes is negative, or the connection
+// is not wrapped by a Limiter.
+func (l *Limiter) TopUpQuota(c Conn, bytes int64) error {
+	conn, ok := innerConn(c)
+	if !ok || conn.quota == nil || bytes < 0 {
+		return ErrInvalidQuota
+	}
+	conn.quota.topUp(l.clock.Now(), bytes)
+	return nil
+}
+
+// Stats returns the aggregate traffic statistics of the Limiter.
+func (l *Limiter) Stats() LimiterStats {
+	l.mu.Lock()
+	activeConns := len(l.conns)
+	totalConns := l.totalConns
+	l.mu.Unlock()
+
+	return LimiterStats{
+		BytesRead:    l.stats.bytesRead.Load(),
+		BytesWritten: l.stats.bytesWritten.Load(),
+		Throttled:    l.stats.throttled.Load(),
+		Throttling:   time.Duration(l.stats.throttling.Load()),
+		Dropped:      l.stats.dropped.Load(),
+		ActiveConns:  activeConns,
+		TotalConns:   totalConns,
+	}
+}
+
+// Conns returns the descriptions of the connections wrapped
+// by the Limiter, which are not closed yet, ordered by their IDs.
+func (l *Limiter) Conns() []ConnInfo {
+	l.mu.Lock()
+	conns := make([]*conn, 0, len(l.conns))
+	for conn := range l.conns {
+		conns = append(conns, conn)
+	}
+	l.mu.Unlock()
+
+	ret := make([]ConnInfo, 0, len(conns))
+	for _, conn := range conns {
+		ret = append(ret, conn.info())
+	}
+	slices.SortFunc(ret, func(a, b ConnInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return ret
+}
+
+// Conn returns the connection of the ID, e.g. to throttle or close
+// a single misbehaving client. The packet connections are returned
+// as Conn, whose stream operations fail. Returns false, when there
+// is no such connection, or it is closed already.
+func (l *Limiter) Conn(id uint64) (Conn, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for conn := range l.conns {
+		if conn.id == id {
+			return conn.outer, true
+		}
+	}
+	return nil, false
+}
+
+// CloseAll closes all of the connections wrapped by the Limiter,
+// which are not closed yet.
+func (l *Limiter) CloseAll() error {
+	l.mu.Lock()
+	conns := make([]*conn, 0, len(l.conns))
+	for conn := range l.conns {
+		conns = append(conns, conn)
+	}
+	l.mu.Unlock()
+
+	var errs []error
+	for _, conn := range conns {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown makes the Limiter refuse new connections, closing them
+// right after wrapping, and waits until all of the connections wrapped
+// so far get closed. Once the context is done, it stops waiting, returning
+// the context's error, e.g. to let the caller use CloseAll.
+func (l *Limiter) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	l.shutdown = true
+	if l.drained == nil {
+		l.drained = make(chan struct{})
+		l.drain()
+	}
+	drained := l.drained
+	l.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drain closes the drained channel, once the Limiter is shut down
+// and no connections are left. The mutex is expected to be held.
+func (l *Limiter) drain() {
+	if l.drained == nil || len(l.conns) > 0 {
+		return
+	}
+	select {
+	case <-l.drained:
+	default:
+		close(l.drained)
+	}
+}
+
+// setGlobalLimit sets the limit of one of the global limiters, waking up
+// the connections waiting in its scheduler's queue (if any).
+func (l *Limiter) setGlobalLimit(lim *rate.Limiter, s *scheduler,
+	limit rate.Limit) {
+	l.burst.setLimitAt(lim, l.clock.Now(), limit)
+	l.wake(s)
+}
+
+// wake wakes up the connections waiting in the schedulers' queues,
+// so that they notice the limit change.
+func (l *Limiter) wake(schedulers ...*scheduler) {
+	for _, s := range schedulers {
+		if s != nil {
+			s.wake()
+		}
+	}
+}
+
+func (l *Limiter) deleteConn(c Conn) {
+	l.mu.Lock()
+	if conn, ok := innerConn(c); ok {
+		delete(l.conns, conn)
+	}
+	l.drain()
+	l.mu.Unlock()
+}
+
+// resetConnLimits makes the connection inherit the local limits again.
+func (l *Limiter) resetConnLimits(conn *conn) {
+	l.mu.Lock()
+	conn.resetLimits(l.localReadLimit, l.localWriteLimit)
 	l.mu.Unlock()
 }
 
@@ -103,16 +506,111 @@ type LimiterOption func(*Limiter)
 // bandwidth limit. See SetGlobalLimit for more information.
 func WithGlobalLimit(limit rate.Limit) LimiterOption {
 	return func(l *Limiter) {
-		l.globalLimiter = rate.NewLimiter(rate.Inf, chunkSize)
+		l.globalReadLimiter.SetLimit(limit)
+		l.globalWriteLimiter.SetLimit(limit)
+	}
+}
+
+// WithGlobalReadLimit is a Limiter option that sets the global
+// read bandwidth limit. See SetGlobalReadLimit for more information.
+func WithGlobalReadLimit(limit rate.Limit) LimiterOption {
+	return func(l *Limiter) {
+		l.globalReadLimiter.SetLimit(limit)
+	}
+}
+
+// WithGlobalWriteLimit is a Limiter option that sets the global
+// write bandwidth limit. See SetGlobalWriteLimit for more information.
+func WithGlobalWriteLimit(limit rate.Limit) LimiterOption {
+	return func(l *Limiter) {
+		l.globalWriteLimiter.SetLimit(limit)
 	}
 }
 
 // WithLocalLimit is a Limiter option that sets the local bandwidth
-// limit aka per connection limit. See SetGlobalLimit for more
+// limit aka per connection limit. See SetLocalLimit for more
 // information.
 func WithLocalLimit(limit rate.Limit) LimiterOption {
 	return func(l *Limiter) {
-		l.localLimit = limit
+		l.localReadLimit = limit
+		l.localWriteLimit = limit
+	}
+}
+
+// WithLocalReadLimit is a Limiter option that sets the local read
+// bandwidth limit. See SetLocalReadLimit for more information.
+func WithLocalReadLimit(limit rate.Limit) LimiterOption {
+	return func(l *Limiter) {
+		l.localReadLimit = limit
+	}
+}
+
+// WithLocalWriteLimit is a Limiter option that sets the local write
+// bandwidth limit. See SetLocalWriteLimit for more information.
+func WithLocalWriteLimit(limit rate.Limit) LimiterOption {
+	return func(l *Limiter) {
+		l.localWriteLimit = limit
+	}
+}
+
+// WithLocalQuota is a Limiter option that sets the per-connection
+// quota. See SetLocalQuota for more information.
+func WithLocalQuota(bytes int64, period time.Duration) LimiterOption {
+	return func(l *Limiter) {
+		l.localQuota = bytes
+		l.localQuotaPeriod = period
+	}
+}
+
+// WithFairUsage is a Limiter option that applies the fair-usage policy
+// to every connection: once the connection has transferred the threshold
+// number of bytes within the current window, its limit drops to the lower
+// tier, until the window rolls over. The observers are notified of
+// the tier changes. Note that getting back to the regular tier takes
+// effect (and is observed) with the first operation after the window
+// rolls over.
+func WithFairUsage(policy FairUsage, observers ...TierObserver) LimiterOption {
+	return func(l *Limiter) {
+		l.fairUsage = &policy
+		l.tierObservers = observers
+	}
+}
+
+// WithBurst is a Limiter option that sets a fixed burst, which is
+// the maximum number of bytes transferred by a single I/O operation.
+// Larger bursts mean fewer I/O operations, but coarser shaping.
+// By default, the burst is 1kB.
+func WithBurst(burst int) LimiterOption {
+	return func(l *Limiter) {
+		l.burst = burstPolicy{size: max(burst, 1)}
+	}
+}
+
+// WithAdaptiveBurst is a Limiter option that makes the bursts follow
+// the limits, so that a single I/O operation transfers as much as
+// the limit allows during the pacing interval (e.g. 10ms). The bursts
+// are recomputed each time the limits change. A non-positive interval
+// falls back to the default, fixed burst.
+func WithAdaptiveBurst(interval time.Duration) LimiterOption {
+	return func(l *Limiter) {
+		if interval <= 0 {
+			l.burst = defaultBurstPolicy
+			return
+		}
+		l.burst = burstPolicy{interval: interval}
+	}
+}
+
+// WithFairSharing is a Limiter option that makes the connections share
+// the global limit fairly. By default, the global limit is handed out on
+// the first-come-first-served basis, so a few aggressive connections may
+// take most of it. With the fair sharing, the active connections get equal
+// shares of the global limit, while the bandwidth left unused by
+// the connections not needing their full share (e.g. because of their
+// local limits) is shared among the others.
+func WithFairSharing() LimiterOption {
+	return func(l *Limiter) {
+		l.fair = true
 	}
 }
 
@@ -129,14 +627,35 @@ func WithClock(clock Clock) LimiterOption {
 // traffic and uses a system clock implementation.
 func NewLimiter(opts ...LimiterOption) (ret *Limiter) {
 	ret = &Limiter{
-		globalLimiter: rate.NewLimiter(rate.Inf, chunkSize),
-		localLimit:    rate.Inf,
-		conns:         make(map[Conn]struct{}),
-		clock:         defaultClock,
+		globalReadLimiter:  rate.NewLimiter(rate.Inf, chunkSize),
+		globalWriteLimiter: rate.NewLimiter(rate.Inf, chunkSize),
+		burst:              defaultBurstPolicy,
+		localReadLimit:     rate.Inf,
+		localWriteLimit:    rate.Inf,
+		localQuota:         UnlimitedQuota,
+		conns:              make(map[*conn]struct{}),
+		clock:              defaultClock,
 	}
 
 	for _, opt := range opts {
 		opt(ret)
 	}
+
+	// The burst policy is known only after applying the options.
+	for _, lim := range []*rate.Limiter{ret.globalReadLimiter, ret.globalWriteLimiter} {
+		lim.SetBurst(ret.burst.burstFor(lim.Limit()))
+	}
+
+	if ret.fair {
+		ret.readScheduler = newScheduler(ret.globalReadLimiter, ret.clock)
+		ret.writeScheduler = newScheduler(ret.globalWriteLimiter, ret.clock)
+	} else {
+		ret.root = ret.root.withLimiters(ret.globalReadLimiter, ret.globalWriteLimiter)
+	}
+
+	// The Schedule is validated by WithSchedule already.
+	if ret.schedule != nil {
+		ret.SetSchedule(ret.schedule)
+	}
 	return
 }
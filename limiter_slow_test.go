@@ -6,6 +6,9 @@ package tcplimit_test
 import (
 	"errors"
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -29,14 +32,14 @@ func performMeasurement(t *testing.T, limiter *tcplimit.Limiter, d time.Duration
 	c := make(chan int64)
 	go func() {
 		n, err := io.Copy(limitedConn, conn)
-		if err != nil && !errors.Is(err, io.EOF) {
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
 			t.Error(err)
 		}
 		c <- n
 	}()
 
 	n, err := io.Copy(conn, limitedConn)
-	if err != nil && !errors.Is(err, io.EOF) {
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
 		t.Error(err)
 	}
 	n += <-c
@@ -64,7 +67,7 @@ func TestLimiterConstraints(t *testing.T) {
 			globalLimit:         rate.Limit(333 * 1024),
 			localLimit:          rate.Inf,
 			connectionCount:     1,
-			expectedBandwidth:   333 * 1024,
+			expectedBandwidth:   2 * 333 * 1024, // read + write
 			acceptableDeviation: 5,
 		},
 		{
@@ -73,7 +76,7 @@ func TestLimiterConstraints(t *testing.T) {
 			globalLimit:         rate.Limit(10 * 1024),
 			localLimit:          rate.Limit(5 * 1024),
 			connectionCount:     1,
-			expectedBandwidth:   5 * 1024,
+			expectedBandwidth:   2 * 5 * 1024, // read + write
 			acceptableDeviation: 5,
 		},
 		{
@@ -82,7 +85,7 @@ func TestLimiterConstraints(t *testing.T) {
 			globalLimit:         rate.Limit(333 * 1024),
 			localLimit:          rate.Inf,
 			connectionCount:     10,
-			expectedBandwidth:   333 * 1024,
+			expectedBandwidth:   2 * 333 * 1024, // read + write
 			acceptableDeviation: 5,
 		},
 		{
@@ -91,10 +94,11 @@ func TestLimiterConstraints(t *testing.T) {
 			globalLimit:         rate.Limit(60 * 1024),
 			localLimit:          rate.Limit(5 * 1024),
 			connectionCount:     10,
-			expectedBandwidth:   50 * 1024, // 5kB * 10
+			expectedBandwidth:   2 * 50 * 1024, // (5kB * 10) * (read + write)
 			acceptableDeviation: 5,
 		},
 	} {
+		test := test
 		t.Run(test.name, func(t *testing.T) {
 			t.Parallel()
 
@@ -126,3 +130,197 @@ func TestLimiterConstraints(t *testing.T) {
 		})
 	}
 }
+
+func performReadMeasurement(t *testing.T, limiter *tcplimit.Limiter, readSize int, d time.Duration) float64 {
+	limitedConn := limiter.LimitConn(
+		mock.NewShortReadConn(mock.NewNoopConn(), readSize),
+	)
+	time.AfterFunc(d, func() {
+		limitedConn.Close()
+	})
+
+	now := time.Now()
+
+	n, err := io.Copy(io.Discard, limitedConn)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		t.Error(err)
+	}
+
+	return float64(n) / time.Since(now).Seconds()
+}
+
+func TestLimiterSmallReadConstraints(t *testing.T) {
+	for _, test := range []struct {
+		name                string
+		duration            time.Duration
+		globalLimit         rate.Limit
+		localLimit          rate.Limit
+		readSize            int
+		expectedBandwidth   float64
+		acceptableDeviation float64
+	}{
+		{
+			name:                "small reads should not deviate more than 5 percent from global",
+			duration:            time.Second * 30,
+			globalLimit:         rate.Limit(64 * 1024),
+			localLimit:          rate.Inf,
+			readSize:            100,
+			expectedBandwidth:   64 * 1024,
+			acceptableDeviation: 5,
+		},
+		{
+			name:                "small reads should not deviate more than 5 percent from local",
+			duration:            time.Second * 30,
+			globalLimit:         rate.Inf,
+			localLimit:          rate.Limit(10 * 1024),
+			readSize:            100,
+			expectedBandwidth:   10 * 1024,
+			acceptableDeviation: 5,
+		},
+		{
+			name:                "single byte reads should not deviate more than 5 percent from local",
+			duration:            time.Second * 30,
+			globalLimit:         rate.Inf,
+			localLimit:          rate.Limit(5 * 1024),
+			readSize:            1,
+			expectedBandwidth:   5 * 1024,
+			acceptableDeviation: 5,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			limiter := tcplimit.NewLimiter()
+			limiter.SetGlobalLimit(test.globalLimit)
+			limiter.SetLocalLimit(test.localLimit)
+
+			bandwidth := performReadMeasurement(t, limiter, test.readSize, test.duration)
+
+			gotDeviation := calculateDeviationInPercent(test.expectedBandwidth, bandwidth)
+			if gotDeviation > test.acceptableDeviation {
+				t.Errorf(
+					"expected deviation to be less than %f, got %f",
+					test.acceptableDeviation,
+					gotDeviation,
+				)
+			}
+		})
+	}
+}
+
+func TestLimiterFairSharing(t *testing.T) {
+	type connection struct {
+		writers           int
+		localLimit        rate.Limit
+		weight            float64
+		priority          int
+		expectedBandwidth float64
+	}
+
+	for _, test := range []struct {
+		name                string
+		duration            time.Duration
+		globalLimit         rate.Limit
+		connections         []connection
+		acceptableDeviation float64
+	}{
+		{
+			name:        "connections should get equal shares regardless of their writers",
+			duration:    time.Second * 30,
+			globalLimit: rate.Limit(90 * 1024),
+			connections: []connection{
+				{writers: 4, localLimit: rate.Inf, expectedBandwidth: 30 * 1024},
+				{writers: 1, localLimit: rate.Inf, expectedBandwidth: 30 * 1024},
+				{writers: 1, localLimit: rate.Inf, expectedBandwidth: 30 * 1024},
+			},
+			acceptableDeviation: 10,
+		},
+		{
+			name:        "unused share should be shared by the other connections",
+			duration:    time.Second * 30,
+			globalLimit: rate.Limit(90 * 1024),
+			connections: []connection{
+				{writers: 4, localLimit: rate.Inf, expectedBandwidth: 40 * 1024},
+				{writers: 1, localLimit: rate.Inf, expectedBandwidth: 40 * 1024},
+				{writers: 1, localLimit: rate.Limit(10 * 1024), expectedBandwidth: 10 * 1024},
+			},
+			acceptableDeviation: 10,
+		},
+		{
+			name:        "connections should get shares proportional to their weights",
+			duration:    time.Second * 30,
+			globalLimit: rate.Limit(90 * 1024),
+			connections: []connection{
+				{writers: 1, localLimit: rate.Inf, weight: 2, expectedBandwidth: 60 * 1024},
+				{writers: 4, localLimit: rate.Inf, weight: 1, expectedBandwidth: 30 * 1024},
+			},
+			acceptableDeviation: 10,
+		},
+		{
+			name:        "higher priority should get all it needs",
+			duration:    time.Second * 30,
+			globalLimit: rate.Limit(90 * 1024),
+			connections: []connection{
+				{writers: 1, localLimit: rate.Limit(30 * 1024), priority: 1, expectedBandwidth: 30 * 1024},
+				{writers: 4, localLimit: rate.Inf, expectedBandwidth: 60 * 1024},
+			},
+			acceptableDeviation: 10,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			limiter := tcplimit.NewLimiter(
+				tcplimit.WithFairSharing(),
+				tcplimit.WithGlobalLimit(test.globalLimit),
+			)
+
+			var wg sync.WaitGroup
+			written := make([]atomic.Int64, len(test.connections))
+			for i, c := range test.connections {
+				conn := limiter.LimitConn(mock.NewNoopConn())
+				conn.SetLimit(c.localLimit)
+				conn.SetPriority(c.priority)
+				if c.weight > 0 {
+					conn.SetWeight(c.weight)
+				}
+				time.AfterFunc(test.duration, func() {
+					conn.Close()
+				})
+
+				for j := 0; j < c.writers; j++ {
+					wg.Add(1)
+					go func(n *atomic.Int64) {
+						defer wg.Done()
+
+						var p [1024]byte
+						for {
+							nn, err := conn.Write(p[:])
+							n.Add(int64(nn))
+							if err != nil {
+								return
+							}
+						}
+					}(&written[i])
+				}
+			}
+			wg.Wait()
+
+			for i, c := range test.connections {
+				bandwidth := float64(written[i].Load()) / test.duration.Seconds()
+
+				gotDeviation := calculateDeviationInPercent(c.expectedBandwidth, bandwidth)
+				if gotDeviation > test.acceptableDeviation {
+					t.Errorf(
+						"connection #%d: expected deviation to be less than %f, got %f",
+						i,
+						test.acceptableDeviation,
+						gotDeviation,
+					)
+				}
+			}
+		})
+	}
+}
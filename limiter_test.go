@@ -1,8 +1,15 @@
 package tcplimit_test
 
 import (
+	"context"
 	"errors"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ksinica/tcplimit"
 	"github.com/ksinica/tcplimit/internal/pkg/mock"
@@ -27,6 +34,121 @@ func TestLimiterLocalLimitPropagation(t *testing.T) {
 	}
 }
 
+func TestLimiterLocalDirectionalLimitPropagation(t *testing.T) {
+	limiter := tcplimit.NewLimiter()
+
+	var conns []tcplimit.Conn
+	for i := 0; i < 10; i++ {
+		conns = append(conns, limiter.LimitConn(mock.NewNoopConn()))
+	}
+
+	limiter.SetLocalReadLimit(rate.Limit(123))
+	limiter.SetLocalWriteLimit(rate.Limit(321))
+
+	for _, conn := range conns {
+		if conn.ReadLimit() != rate.Limit(123) {
+			t.Errorf("expected read limit %v, got %v", rate.Limit(123), conn.ReadLimit())
+		}
+		if conn.WriteLimit() != rate.Limit(321) {
+			t.Errorf("expected write limit %v, got %v", rate.Limit(321), conn.WriteLimit())
+		}
+		if conn.Limit() != rate.Limit(123) {
+			t.Errorf("expected limit %v, got %v", rate.Limit(123), conn.Limit())
+		}
+	}
+}
+
+func TestLimiterLocalLimitOverride(t *testing.T) {
+	limiter := tcplimit.NewLimiter()
+
+	inherited := limiter.LimitConn(mock.NewNoopConn())
+	overridden := limiter.LimitConn(mock.NewNoopConn())
+	readOverridden := limiter.LimitConn(mock.NewNoopConn())
+
+	overridden.SetLimit(rate.Limit(1000))
+	readOverridden.SetReadLimit(rate.Limit(1000))
+
+	limiter.SetLocalLimit(rate.Limit(321))
+
+	for _, test := range []struct {
+		name          string
+		conn          tcplimit.Conn
+		expectedRead  rate.Limit
+		expectedWrite rate.Limit
+	}{
+		{"inherited", inherited, 321, 321},
+		{"overridden", overridden, 1000, 1000},
+		{"read overridden", readOverridden, 1000, 321},
+	} {
+		if got := test.conn.ReadLimit(); got != test.expectedRead {
+			t.Errorf("%s: expected read limit %v, got %v", test.name, test.expectedRead, got)
+		}
+		if got := test.conn.WriteLimit(); got != test.expectedWrite {
+			t.Errorf("%s: expected write limit %v, got %v", test.name, test.expectedWrite, got)
+		}
+	}
+
+	overridden.ResetLimit()
+	if got := overridden.Limit(); got != rate.Limit(321) {
+		t.Errorf("expected reset limit %v, got %v", rate.Limit(321), got)
+	}
+
+	// Once reset, the connection should follow the Limiter again.
+	limiter.SetLocalLimit(rate.Limit(123))
+	if got := overridden.Limit(); got != rate.Limit(123) {
+		t.Errorf("expected inherited limit %v, got %v", rate.Limit(123), got)
+	}
+}
+
+func TestLimiterGlobalLimitOption(t *testing.T) {
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithGlobalLimit(rate.Limit(1024)),
+		tcplimit.WithGlobalWriteLimit(rate.Limit(512)),
+	)
+
+	if limiter.GlobalReadLimit() != rate.Limit(1024) {
+		t.Errorf("expected read limit %v, got %v", rate.Limit(1024), limiter.GlobalReadLimit())
+	}
+	if limiter.GlobalWriteLimit() != rate.Limit(512) {
+		t.Errorf("expected write limit %v, got %v", rate.Limit(512), limiter.GlobalWriteLimit())
+	}
+}
+
+func TestLimiterAdaptiveBurst(t *testing.T) {
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithAdaptiveBurst(10*time.Millisecond),
+		tcplimit.WithLocalLimit(rate.Limit(100*1024)),
+	)
+
+	conn := limiter.LimitConn(mock.NewNoopConn())
+	defer conn.Close()
+
+	if conn.Burst() != 1024 {
+		t.Errorf("expected burst %d, got %d", 1024, conn.Burst())
+	}
+
+	limiter.SetLocalLimit(rate.Limit(200))
+
+	if conn.Burst() != 2 {
+		t.Errorf("expected burst %d, got %d", 2, conn.Burst())
+	}
+}
+
+func TestLimiterAdaptiveBurstNonPositiveInterval(t *testing.T) {
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithAdaptiveBurst(0),
+		tcplimit.WithLocalLimit(rate.Limit(1000)),
+	)
+
+	conn := limiter.LimitConn(mock.NewNoopConn())
+	defer conn.Close()
+
+	// The default burst is used instead.
+	if conn.Burst() != 1024 {
+		t.Errorf("expected burst %d, got %d", 1024, conn.Burst())
+	}
+}
+
 func TestLimiterInvalidGlobalLimit(t *testing.T) {
 	limiter := tcplimit.NewLimiter()
 
@@ -44,3 +166,797 @@ func TestLimiterInvalidLocalLimit(t *testing.T) {
 		t.Errorf("expected %s, got %s", tcplimit.ErrInvalidLimit, err)
 	}
 }
+
+func TestLimiterInvalidWeight(t *testing.T) {
+	limiter := tcplimit.NewLimiter(tcplimit.WithFairSharing())
+
+	conn := limiter.LimitConn(mock.NewNoopConn())
+	defer conn.Close()
+
+	for _, weight := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		err := conn.SetWeight(weight)
+		if !errors.Is(err, tcplimit.ErrInvalidWeight) {
+			t.Errorf("expected %s, got %s", tcplimit.ErrInvalidWeight, err)
+		}
+	}
+}
+
+func TestLimiterStats(t *testing.T) {
+	now := time.Now()
+	created := now
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithLocalWriteLimit(rate.Limit(1024)),
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+			OnSleep: func(d time.Duration) {
+				now = now.Add(d)
+			},
+		}),
+	)
+
+	conn := limiter.LimitConn(mock.NewNoopConn())
+
+	// The first kilobyte fits in the burst.
+	if _, err := conn.Write(make([]byte, 3*1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := conn.Read(make([]byte, 100)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	expectedConnStats := tcplimit.ConnStats{
+		BytesRead:    100,
+		BytesWritten: 3 * 1024,
+		Throttled:    2,
+		Throttling:   2 * time.Second,
+		Created:      created,
+	}
+	if got := conn.Stats(); got != expectedConnStats {
+		t.Errorf("expected %+v, got %+v", expectedConnStats, got)
+	}
+
+	conn.Close()
+
+	// The stats should survive the connection.
+	expectedLimiterStats := tcplimit.LimiterStats{
+		BytesRead:    100,
+		BytesWritten: 3 * 1024,
+		Throttled:    2,
+		Throttling:   2 * time.Second,
+		ActiveConns:  0,
+		TotalConns:   1,
+	}
+	if got := limiter.Stats(); got != expectedLimiterStats {
+		t.Errorf("expected %+v, got %+v", expectedLimiterStats, got)
+	}
+}
+
+func TestLimiterLocalQuota(t *testing.T) {
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithLocalQuota(3*1024, time.Hour),
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+		}),
+	)
+
+	conn := limiter.LimitConn(mock.NewNoopConn())
+	defer conn.Close()
+
+	// Both directions count towards the quota.
+	if _, err := conn.Read(make([]byte, 1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	n, err := conn.Write(make([]byte, 4*1024))
+	if !errors.Is(err, tcplimit.ErrQuotaExceeded) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrQuotaExceeded, err)
+	}
+	if n != 2*1024 {
+		t.Errorf("expected %d bytes written, got %d", 2*1024, n)
+	}
+	if got := limiter.RemainingQuota(conn); got != 0 {
+		t.Errorf("expected no remaining quota, got %d", got)
+	}
+
+	if err := limiter.TopUpQuota(conn, 100); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if n, _ := conn.Read(make([]byte, 1024)); n != 100 {
+		t.Errorf("expected %d bytes read, got %d", 100, n)
+	}
+	if _, err := conn.Read(make([]byte, 1024)); !errors.Is(err, tcplimit.ErrQuotaExceeded) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrQuotaExceeded, err)
+	}
+
+	// The quota is reset, along with the bytes topped up, in the next period.
+	now = now.Add(time.Hour)
+	if got := limiter.RemainingQuota(conn); got != 3*1024 {
+		t.Errorf("expected remaining quota %d, got %d", 3*1024, got)
+	}
+	if _, err := conn.Write(make([]byte, 1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// Changing the quota keeps the bytes transferred so far.
+	if err := limiter.SetLocalQuota(4*1024, time.Hour); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if got := limiter.RemainingQuota(conn); got != 3*1024 {
+		t.Errorf("expected remaining quota %d, got %d", 3*1024, got)
+	}
+}
+
+func TestLimiterLocalQuotaBlockedRead(t *testing.T) {
+	limiter := tcplimit.NewLimiter(tcplimit.WithLocalQuota(1500, 0))
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := limiter.LimitConn(c1)
+	defer conn.Close()
+
+	go io.Copy(io.Discard, c2)
+	if _, err := conn.Write(make([]byte, 1000)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// The read waiting for the peer must not hold the rest of the quota.
+	read := make(chan int)
+	go func() {
+		n, _ := conn.Read(make([]byte, 1024))
+		read <- n
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := conn.Write(make([]byte, 100)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if got := limiter.RemainingQuota(conn); got != 400 {
+		t.Errorf("expected remaining quota %d, got %d", 400, got)
+	}
+
+	if _, err := c2.Write(make([]byte, 10)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if n := <-read; n != 10 {
+		t.Errorf("expected %d bytes read, got %d", 10, n)
+	}
+	if got := limiter.RemainingQuota(conn); got != 390 {
+		t.Errorf("expected remaining quota %d, got %d", 390, got)
+	}
+}
+
+func TestLimiterInvalidQuota(t *testing.T) {
+	limiter := tcplimit.NewLimiter()
+
+	if err := limiter.SetLocalQuota(-1, 0); !errors.Is(err, tcplimit.ErrInvalidQuota) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrInvalidQuota, err)
+	}
+	if err := limiter.SetLocalQuota(0, -time.Second); !errors.Is(err, tcplimit.ErrInvalidQuota) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrInvalidQuota, err)
+	}
+
+	conn := limiter.LimitConn(mock.NewNoopConn())
+	defer conn.Close()
+
+	if err := limiter.TopUpQuota(conn, -1); !errors.Is(err, tcplimit.ErrInvalidQuota) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrInvalidQuota, err)
+	}
+}
+
+// closeWriteConn is a connection, which can be half-closed.
+type closeWriteConn struct {
+	net.Conn
+}
+
+func (closeWriteConn) CloseWrite() error {
+	return nil
+}
+
+func TestLimiterFairUsageObservedConn(t *testing.T) {
+	var changes []tcplimit.TierChange
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithFairUsage(
+			tcplimit.FairUsage{
+				Threshold: 1024,
+				Window:    time.Hour,
+				Limit:     rate.Limit(1024),
+			},
+			func(change tcplimit.TierChange) {
+				changes = append(changes, change)
+			},
+		),
+	)
+
+	conn := limiter.LimitConn(closeWriteConn{mock.NewNoopConn()})
+	defer conn.Close()
+
+	if _, err := conn.Write(make([]byte, 1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// The observers get the very Conn handed out, with its optional
+	// interfaces.
+	if len(changes) != 1 || changes[0].Conn != conn {
+		t.Fatalf("expected the change of the connection, got %+v", changes)
+	}
+	if _, ok := changes[0].Conn.(interface{ CloseWrite() error }); !ok {
+		t.Error("expected the observed connection to implement CloseWrite")
+	}
+}
+
+func TestLimiterFairUsage(t *testing.T) {
+	var slept time.Duration
+	now := time.Now()
+	var changes []tcplimit.TierChange
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithFairUsage(
+			tcplimit.FairUsage{
+				Threshold: 2 * 1024,
+				Window:    time.Hour,
+				Limit:     rate.Limit(1024),
+			},
+			func(change tcplimit.TierChange) {
+				changes = append(changes, change)
+			},
+		),
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+			OnSleep: func(d time.Duration) {
+				slept += d
+				now = now.Add(d)
+			},
+		}),
+	)
+
+	conn := limiter.LimitConn(mock.NewNoopConn())
+	defer conn.Close()
+
+	if _, err := conn.Write(make([]byte, 2*1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if slept != 0 {
+		t.Errorf("expected no throttling below the threshold, got %s", slept)
+	}
+	if len(changes) != 1 || !changes[0].Downgraded || changes[0].Conn != conn {
+		t.Fatalf("expected the connection to be downgraded, got %+v", changes)
+	}
+
+	// The first kilobyte fits in the burst.
+	if _, err := conn.Write(make([]byte, 3*1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if slept != 2*time.Second {
+		t.Errorf("expected write to be throttled for %s, got %s", 2*time.Second, slept)
+	}
+
+	now = now.Add(time.Hour)
+	slept = 0
+	if _, err := conn.Write(make([]byte, 1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if slept != 0 {
+		t.Errorf("expected no throttling in the next window, got %s", slept)
+	}
+	if len(changes) != 2 || changes[1].Downgraded {
+		t.Errorf("expected the connection to be upgraded, got %+v", changes)
+	}
+}
+
+func TestLimiterSchedule(t *testing.T) {
+	var mu sync.Mutex
+	// 2024-01-01 is a Monday.
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	type timer struct {
+		d    time.Duration
+		fire chan time.Time
+	}
+	timers := make(chan timer)
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			},
+			OnNewTimer: func(d time.Duration) (<-chan time.Time, func() bool) {
+				fire := make(chan time.Time, 1)
+				timers <- timer{d, fire}
+				return fire, func() bool { return true }
+			},
+		}),
+	)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- limiter.SetSchedule(&tcplimit.Schedule{
+			Rules: []tcplimit.ScheduleRule{
+				{
+					Weekdays: []time.Weekday{
+						time.Monday, time.Tuesday, time.Wednesday,
+						time.Thursday, time.Friday,
+					},
+					Start:       9 * time.Hour,
+					End:         17 * time.Hour,
+					GlobalLimit: rate.Limit(10 * 1024 * 1024),
+					LocalLimit:  rate.Limit(1024 * 1024),
+				},
+			},
+			GlobalLimit: rate.Inf,
+			LocalLimit:  rate.Inf,
+			Location:    time.UTC,
+		})
+	}()
+
+	next := <-timers
+	if err := <-errc; err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if got := limiter.GlobalLimit(); got != rate.Inf {
+		t.Errorf("expected global limit %v, got %v", rate.Inf, got)
+	}
+	if next.d != time.Hour {
+		t.Errorf("expected to wait %s, got %s", time.Hour, next.d)
+	}
+
+	mu.Lock()
+	now = now.Add(time.Hour)
+	mu.Unlock()
+	next.fire <- now
+
+	// The next timer is created after switching the limits.
+	next = <-timers
+	if got := limiter.GlobalLimit(); got != rate.Limit(10*1024*1024) {
+		t.Errorf("expected global limit %v, got %v", rate.Limit(10*1024*1024), got)
+	}
+	if got := limiter.LocalLimit(); got != rate.Limit(1024*1024) {
+		t.Errorf("expected local limit %v, got %v", rate.Limit(1024*1024), got)
+	}
+	if next.d != 8*time.Hour {
+		t.Errorf("expected to wait %s, got %s", 8*time.Hour, next.d)
+	}
+
+	if err := limiter.SetSchedule(nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := limiter.SetSchedule(&tcplimit.Schedule{GlobalLimit: -1}); !errors.Is(err, tcplimit.ErrInvalidSchedule) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrInvalidSchedule, err)
+	}
+}
+
+func TestLimiterRampGlobalLimit(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithGlobalLimit(rate.Limit(1000)),
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			},
+			OnSleep: func(d time.Duration) {
+				mu.Lock()
+				now = now.Add(d)
+				mu.Unlock()
+			},
+		}),
+	)
+
+	if err := limiter.RampGlobalLimit(rate.Limit(2000), time.Second); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// The ramp runs on the mock clock, so it ends right away.
+	for limiter.GlobalLimit() != rate.Limit(2000) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := limiter.GlobalReadLimit(); got != rate.Limit(2000) {
+		t.Errorf("expected global read limit %v, got %v", rate.Limit(2000), got)
+	}
+}
+
+func TestLimiterRampCancellation(t *testing.T) {
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithLocalLimit(rate.Limit(1000)),
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: time.Now,
+			OnNewTimer: func(time.Duration) (<-chan time.Time, func() bool) {
+				// The ramp never makes a step.
+				return nil, func() bool { return true }
+			},
+		}),
+	)
+
+	if err := limiter.RampLocalLimit(rate.Limit(2000), time.Second); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// A new ramp replaces the one in progress.
+	if err := limiter.RampLocalLimit(rate.Limit(3000), 0); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if got := limiter.LocalLimit(); got != rate.Limit(3000) {
+		t.Errorf("expected local limit %v, got %v", rate.Limit(3000), got)
+	}
+
+	if err := limiter.RampLocalLimit(rate.Limit(2000), time.Second, tcplimit.WithExponentialRamp()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := limiter.SetLocalLimit(rate.Limit(500)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if got := limiter.LocalLimit(); got != rate.Limit(500) {
+		t.Errorf("expected local limit %v, got %v", rate.Limit(500), got)
+	}
+
+	if err := limiter.RampGlobalLimit(rate.Limit(-1), time.Second); !errors.Is(err, tcplimit.ErrInvalidLimit) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrInvalidLimit, err)
+	}
+}
+
+func TestLimiterCredits(t *testing.T) {
+	var slept time.Duration
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithCredits(tcplimit.Credits{
+			Baseline: rate.Limit(1024),
+			Cap:      4 * 1024,
+			Initial:  3 * 1024,
+		}),
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+			OnSleep: func(d time.Duration) {
+				slept += d
+				now = now.Add(d)
+			},
+		}),
+	)
+
+	conn := limiter.LimitConn(mock.NewNoopConn())
+	defer conn.Close()
+
+	// The initial credits are spent right away...
+	if _, err := conn.Write(make([]byte, 3*1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if slept != 0 {
+		t.Errorf("expected no throttling with credits, got %s", slept)
+	}
+	// ...then the connection settles at the baseline rate.
+	if _, err := conn.Write(make([]byte, 2*1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if slept != 2*time.Second {
+		t.Errorf("expected write to be throttled for %s, got %s", 2*time.Second, slept)
+	}
+
+	// While idle, the connection earns credits up to the cap.
+	now = now.Add(time.Minute)
+	slept = 0
+	if _, err := conn.Write(make([]byte, 5*1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if slept != time.Second {
+		t.Errorf("expected write to be throttled for %s, got %s", time.Second, slept)
+	}
+
+	// The directions have their own credits.
+	if _, err := conn.Read(make([]byte, 1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if slept != time.Second {
+		t.Errorf("expected read not to be throttled, got %s", slept-time.Second)
+	}
+}
+
+func TestLimiterInvalidCredits(t *testing.T) {
+	for _, credits := range []tcplimit.Credits{
+		{Cap: 4096, Initial: 4096},
+		{Baseline: rate.Limit(-1), Cap: 4096, Initial: 4096},
+		{Baseline: rate.Limit(1024), Initial: 4096},
+	} {
+		limiter := tcplimit.NewLimiter(tcplimit.WithCredits(credits))
+		conn := limiter.LimitConn(mock.NewNoopConn())
+
+		if _, err := conn.Write(make([]byte, 4096)); err != nil {
+			t.Errorf("expected the credits %+v to be ignored, got %v", credits, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestLimiterLatency(t *testing.T) {
+	var mu sync.Mutex
+	var (
+		waited time.Duration
+		writes []int
+	)
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithLatency(100*time.Millisecond),
+		tcplimit.WithJitter(time.Millisecond),
+		tcplimit.WithMTU(500),
+		// A single write, so that the data is segmented at once.
+		tcplimit.WithBurst(4096),
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			},
+			OnSleep: func(d time.Duration) {
+				mu.Lock()
+				waited += d
+				now = now.Add(d)
+				mu.Unlock()
+			},
+		}),
+	)
+
+	conn := limiter.LimitConn(mock.NewWriteHookConn(mock.NewNoopConn(), func(p []byte) {
+		mu.Lock()
+		writes = append(writes, len(p))
+		mu.Unlock()
+	}))
+
+	if n, err := conn.Write(make([]byte, 1200)); err != nil || n != 1200 {
+		t.Fatalf("expected %d bytes written, got %d (%v)", 1200, n, err)
+	}
+	// Closing the connection waits for the data in flight.
+	conn.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(writes, []int{500, 500, 200}) {
+		t.Errorf("expected the data delivered in segments, got %v", writes)
+	}
+	if waited < 99*time.Millisecond || waited > 101*time.Millisecond {
+		t.Errorf("expected the delivery to be delayed by %s, got %s", 100*time.Millisecond, waited)
+	}
+}
+
+func TestLimiterLatencyPeerNotReading(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	limiter := tcplimit.NewLimiter(tcplimit.WithLatency(time.Millisecond))
+	conn := limiter.LimitConn(local)
+
+	if _, err := conn.Write(make([]byte, 10)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// The peer never reads, so the delivery blocks, but closing must not.
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to close")
+	}
+}
+
+func TestLimiterFaults(t *testing.T) {
+	var mu sync.Mutex
+	var slept time.Duration
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			},
+			OnSleep: func(d time.Duration) {
+				mu.Lock()
+				slept += d
+				now = now.Add(d)
+				mu.Unlock()
+			},
+		}),
+	)
+
+	t.Run("close after bytes", func(t *testing.T) {
+		conn := limiter.LimitConn(mock.NewNoopConn())
+		defer conn.Close()
+
+		if err := limiter.InjectConnFaults(conn, tcplimit.Faults{CloseAfterBytes: 1500}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if _, err := conn.Write(make([]byte, 1024)); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		n, err := conn.Write(make([]byte, 1024))
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("expected %s, got %s", net.ErrClosed, err)
+		}
+		if n != 1500-1024 {
+			t.Errorf("expected %d bytes written, got %d", 1500-1024, n)
+		}
+	})
+
+	t.Run("stall", func(t *testing.T) {
+		conn := limiter.LimitConn(mock.NewNoopConn())
+		defer conn.Close()
+
+		mu.Lock()
+		slept = 0
+		mu.Unlock()
+		if err := limiter.InjectConnFaults(conn, tcplimit.Faults{Stall: 5 * time.Second}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if _, err := conn.Read(make([]byte, 1024)); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if slept != 5*time.Second {
+			t.Errorf("expected read to stall for %s, got %s", 5*time.Second, slept)
+		}
+	})
+
+	t.Run("error rate", func(t *testing.T) {
+		faults := tcplimit.Faults{ErrorRate: 0.5, Seed: 42}
+		// The outcomes of two connections of two Limiters each.
+		var outcomes [2][2][]bool
+		for i := range outcomes {
+			limiter := tcplimit.NewLimiter()
+			if err := limiter.InjectFaults(faults); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			for j := range outcomes[i] {
+				conn := limiter.LimitConn(mock.NewNoopConn())
+				defer conn.Close()
+
+				for k := 0; k < 32; k++ {
+					_, err := conn.Read(make([]byte, 1))
+					if err != nil && !errors.Is(err, tcplimit.ErrFaultInjected) {
+						t.Fatal("unexpected error:", err)
+					}
+					outcomes[i][j] = append(outcomes[i][j], err == nil)
+				}
+			}
+		}
+		// The same seed makes the same faults, but the connections
+		// don't fail all at once.
+		for j := range outcomes[0] {
+			if !slices.Equal(outcomes[0][j], outcomes[1][j]) {
+				t.Errorf("expected reproducible faults, got %v and %v", outcomes[0][j], outcomes[1][j])
+			}
+		}
+		if slices.Equal(outcomes[0][0], outcomes[0][1]) {
+			t.Errorf("expected the connections to fail independently, got %v", outcomes[0][0])
+		}
+		if !slices.Contains(outcomes[0][0], true) || !slices.Contains(outcomes[0][0], false) {
+			t.Errorf("expected some of the operations to fail, got %v", outcomes[0][0])
+		}
+	})
+
+	t.Run("half close", func(t *testing.T) {
+		conn := limiter.LimitConn(mock.NewNoopConn())
+		defer conn.Close()
+
+		if err := limiter.InjectConnFaults(conn, tcplimit.Faults{HalfClose: true}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if _, err := conn.Write(make([]byte, 1)); !errors.Is(err, tcplimit.ErrFaultInjected) {
+			t.Errorf("expected %s, got %s", tcplimit.ErrFaultInjected, err)
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	})
+
+	t.Run("all connections", func(t *testing.T) {
+		conn := limiter.LimitConn(mock.NewNoopConn())
+		defer conn.Close()
+
+		// The mock timers fire right away.
+		if err := limiter.InjectFaults(tcplimit.Faults{CloseAfter: time.Second}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		for limiter.Stats().ActiveConns != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if err := limiter.InjectFaults(tcplimit.Faults{}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	})
+
+	if err := limiter.InjectFaults(tcplimit.Faults{ErrorRate: 2}); !errors.Is(err, tcplimit.ErrInvalidFaults) {
+		t.Errorf("expected %s, got %s", tcplimit.ErrInvalidFaults, err)
+	}
+}
+
+func TestLimiterCloseAll(t *testing.T) {
+	limiter := tcplimit.NewLimiter()
+	conns := []tcplimit.Conn{
+		limiter.LimitConn(mock.NewNoopConn()),
+		limiter.LimitConn(mock.NewNoopConn()),
+	}
+
+	if err := limiter.CloseAll(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if stats := limiter.Stats(); stats.ActiveConns != 0 {
+		t.Errorf("expected no active connections, got %d", stats.ActiveConns)
+	}
+	for _, conn := range conns {
+		if _, err := conn.Write(make([]byte, 1)); err == nil {
+			t.Error("expected the connection to be closed")
+		}
+	}
+}
+
+func TestLimiterShutdown(t *testing.T) {
+	limiter := tcplimit.NewLimiter()
+	group := limiter.NewGroup()
+	conn := group.LimitConn(mock.NewNoopConn())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// New connections are refused.
+	refused := group.LimitConn(mock.NewNoopConn())
+	if _, err := refused.Write(make([]byte, 1)); err == nil {
+		t.Error("expected the new connection to be closed")
+	}
+	if conns := group.Conns(); len(conns) != 1 {
+		t.Errorf("expected the refused connection not to be tracked, got %d connections", len(conns))
+	}
+
+	go conn.Close()
+	if err := limiter.Shutdown(context.Background()); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestLimiterConns(t *testing.T) {
+	limiter := tcplimit.NewLimiter()
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	first := limiter.LimitConn(mock.NewRemoteAddrConn(mock.NewNoopConn(), addr))
+	defer first.Close()
+	second := limiter.LimitConn(mock.NewNoopConn())
+	defer second.Close()
+
+	first.SetLabel("tenant", "acme")
+	second.SetWriteLimit(rate.Limit(1024))
+
+	infos := limiter.Conns()
+	if len(infos) != 2 {
+		t.Fatalf("expected %d connections, got %d", 2, len(infos))
+	}
+	if infos[0].ID != first.ID() || infos[1].ID != second.ID() {
+		t.Errorf("expected the connections ordered by their IDs, got %d and %d", infos[0].ID, infos[1].ID)
+	}
+	if infos[0].RemoteAddr != addr || infos[0].Labels["tenant"] != "acme" {
+		t.Errorf("unexpected description of the first connection: %+v", infos[0])
+	}
+	if infos[1].WriteLimit != rate.Limit(1024) || infos[1].ReadLimit != rate.Inf {
+		t.Errorf("unexpected limits of the second connection: %v and %v", infos[1].ReadLimit, infos[1].WriteLimit)
+	}
+
+	// A single connection can be looked up and closed.
+	conn, ok := limiter.Conn(first.ID())
+	if !ok || conn != first {
+		t.Fatal("expected the connection to be found")
+	}
+	conn.Close()
+	if _, ok := limiter.Conn(first.ID()); ok {
+		t.Error("expected the closed connection not to be found")
+	}
+	if infos := limiter.Conns(); len(infos) != 1 {
+		t.Errorf("expected %d connection, got %d", 1, len(infos))
+	}
+}
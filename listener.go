@@ -1,12 +1,23 @@
 package tcplimit
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
+const (
+	// listenerQueueLen is the maximum number of accepted connections
+	// waiting for a free slot of a single remote IP address. The ones
+	// over it are closed, so that a single client cannot hold up
+	// the others.
+	listenerQueueLen = 128
+)
+
 // LmitedListener is a wrapper on the net.Listener that accepts
 // bandwidth-limited connection.
 type LimitedListener interface {
@@ -18,18 +29,324 @@ type LimitedListener interface {
 	SetLimits(global, local int) error
 }
 
+// acceptResult is a result of accepting a connection.
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
 type limitedListener struct {
 	net.Listener
 
 	limiter *Limiter
+	// maxConns and maxConnsPerIP cap the number of concurrent connections,
+	// when positive.
+	maxConns      int
+	maxConnsPerIP int
+	// acceptLimiter, when set, limits the accept rate.
+	acceptLimiter *rate.Limiter
+	// reject makes the listener close the excess connections,
+	// instead of queueing them.
+	reject bool
+	// drain, when positive, makes Close wait for the accepted connections
+	// to close, up to that long.
+	drain time.Duration
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	results   chan acceptResult
+	done      chan struct{}
+	// released is notified whenever a slot gets released.
+	released chan struct{}
+
+	mu    sync.Mutex
+	conns int
+	perIP map[string]int
+	// waiting are the connections accepted, but waiting for a free slot
+	// of their remote IP address, counted per address by waitingPerIP.
+	waiting      []net.Conn
+	waitingPerIP map[string]int
+	// accepted are the connections accepted, which are not closed yet.
+	// Once the listener is closed, drained gets closed when no
+	// connections are left.
+	accepted map[Conn]struct{}
+	closed   bool
+	drained  chan struct{}
 }
 
 func (l *limitedListener) Accept() (net.Conn, error) {
-	conn, err := l.Listener.Accept()
-	if err != nil {
-		return nil, err
+	if !l.capped() {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		return l.wrap(conn, ""), nil
 	}
-	return l.limiter.LimitConn(conn), nil
+
+	// The connections are accepted in the background, so that
+	// the ones waiting for their slots don't hold up the others.
+	l.startOnce.Do(func() {
+		go l.run()
+	})
+
+	select {
+	case r := <-l.results:
+		return r.conn, r.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// capped tells whether the listener caps the connections in any way.
+func (l *limitedListener) capped() bool {
+	return l.maxConns > 0 || l.maxConnsPerIP > 0 || l.acceptLimiter != nil
+}
+
+// run accepts the connections, until the listener gets closed.
+func (l *limitedListener) run() {
+	for {
+		if !l.waitAcceptRate() || !l.waitRoom() {
+			return
+		}
+
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if !l.deliver(acceptResult{err: err}) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		l.admit(conn)
+	}
+}
+
+// waitAcceptRate waits until the accept rate allows another connection.
+// Returns false, when the listener gets closed in the meantime.
+func (l *limitedListener) waitAcceptRate() bool {
+	if l.acceptLimiter == nil {
+		return true
+	}
+
+	now := l.limiter.clock.Now()
+	d := l.acceptLimiter.ReserveN(now, 1).DelayFrom(now)
+	if d <= 0 {
+		return true
+	}
+
+	elapsed, stop := l.limiter.clock.NewTimer(d)
+	defer stop()
+	select {
+	case <-elapsed:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// waitRoom waits until there is room for another connection, leaving
+// the excess ones in the listen backlog. The listener closing them
+// instead doesn't wait. Returns false, when the listener gets closed
+// in the meantime.
+func (l *limitedListener) waitRoom() bool {
+	if l.reject {
+		return true
+	}
+
+	for {
+		l.mu.Lock()
+		full := l.maxConns > 0 && l.conns >= l.maxConns
+		l.mu.Unlock()
+		if !full {
+			return true
+		}
+
+		select {
+		case <-l.released:
+		case <-l.done:
+			return false
+		}
+	}
+}
+
+// admit delivers the connection, if there is a free slot for it.
+// Otherwise, the connection is either closed or queued, unless the queue
+// of its remote IP address is full.
+func (l *limitedListener) admit(conn net.Conn) {
+	ip := RemoteIP(conn)
+
+	l.mu.Lock()
+	if l.fits(ip) {
+		l.take(ip)
+		l.mu.Unlock()
+		l.deliver(acceptResult{conn: l.wrap(conn, ip)})
+		return
+	}
+	if l.reject || l.waitingPerIP[ip] >= listenerQueueLen {
+		l.mu.Unlock()
+		conn.Close()
+		return
+	}
+	l.waiting = append(l.waiting, conn)
+	l.waitingPerIP[ip]++
+	l.mu.Unlock()
+}
+
+// fits tells whether there is a free slot for a connection from the IP
+// address. The mutex is expected to be held.
+func (l *limitedListener) fits(ip string) bool {
+	return (l.maxConns <= 0 || l.conns < l.maxConns) &&
+		(l.maxConnsPerIP <= 0 || l.perIP[ip] < l.maxConnsPerIP)
+}
+
+// take takes a slot for a connection from the IP address.
+// The mutex is expected to be held.
+func (l *limitedListener) take(ip string) {
+	l.conns++
+	l.perIP[ip]++
+}
+
+// release releases the slot of a closed connection, handing it over
+// to the first of the waiting connections, which fits.
+func (l *limitedListener) release(ip string) {
+	l.mu.Lock()
+	l.conns--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+
+	var next net.Conn
+	var nextIP string
+	for i, conn := range l.waiting {
+		if nextIP = RemoteIP(conn); l.fits(nextIP) {
+			l.take(nextIP)
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			if l.waitingPerIP[nextIP]--; l.waitingPerIP[nextIP] <= 0 {
+				delete(l.waitingPerIP, nextIP)
+			}
+			next = conn
+			break
+		}
+	}
+	l.mu.Unlock()
+
+	select {
+	case l.released <- struct{}{}:
+	default:
+	}
+
+	if next != nil {
+		// Closing a connection must not wait for it to be accepted.
+		go l.deliver(acceptResult{conn: l.wrap(next, nextIP)})
+	}
+}
+
+// wrap wraps the connection, so that it releases its slot (if any)
+// when closed.
+func (l *limitedListener) wrap(conn net.Conn, ip string) Conn {
+	ret := l.limiter.limitConn(conn, l.limiter.root, func(c Conn) {
+		l.limiter.deleteConn(c)
+		l.forget(c)
+		if l.capped() {
+			l.release(ip)
+		}
+	})
+
+	// The connection is closed already, when the Limiter is shut down.
+	if inner, _ := innerConn(ret); inner.isClosed() {
+		return ret
+	}
+
+	l.mu.Lock()
+	l.accepted[ret] = struct{}{}
+	l.mu.Unlock()
+	return ret
+}
+
+// forget forgets the closed connection.
+func (l *limitedListener) forget(c Conn) {
+	l.mu.Lock()
+	delete(l.accepted, c)
+	l.drainIfEmpty()
+	l.mu.Unlock()
+}
+
+// drainIfEmpty closes the drained channel, once the listener is closed
+// and no connections are left. The mutex is expected to be held.
+func (l *limitedListener) drainIfEmpty() {
+	if !l.closed || len(l.accepted) > 0 {
+		return
+	}
+	select {
+	case <-l.drained:
+	default:
+		close(l.drained)
+	}
+}
+
+// waitDrained waits for the accepted connections to close, up to
+// the drain timeout, closing the remaining ones afterwards.
+func (l *limitedListener) waitDrained() {
+	elapsed, stop := l.limiter.clock.NewTimer(l.drain)
+	defer stop()
+
+	select {
+	case <-l.drained:
+		return
+	case <-elapsed:
+	}
+
+	l.mu.Lock()
+	conns := make([]Conn, 0, len(l.accepted))
+	for conn := range l.accepted {
+		conns = append(conns, conn)
+	}
+	l.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// deliver hands the result over to Accept. Returns false, when
+// the listener gets closed in the meantime, closing the connection
+// (if any).
+func (l *limitedListener) deliver(r acceptResult) bool {
+	select {
+	case l.results <- r:
+		return true
+	case <-l.done:
+		if r.conn != nil {
+			r.conn.Close()
+		}
+		return false
+	}
+}
+
+// Close stops accepting the connections. In the drain mode
+// (see WithDrain), it also waits for the accepted connections to close.
+func (l *limitedListener) Close() (err error) {
+	err = l.Listener.Close()
+
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		l.mu.Lock()
+		waiting := l.waiting
+		l.waiting = nil
+		clear(l.waitingPerIP)
+		l.closed = true
+		l.drainIfEmpty()
+		l.mu.Unlock()
+
+		for _, conn := range waiting {
+			conn.Close()
+		}
+
+		if l.drain > 0 {
+			l.waitDrained()
+		}
+	})
+	return
 }
 
 func (l *limitedListener) SetLimits(global, local int) error {
@@ -44,9 +361,81 @@ func (l *limitedListener) SetLimits(global, local int) error {
 	return nil
 }
 
-func NewListener(l net.Listener) LimitedListener {
-	return &limitedListener{
-		Listener: l,
-		limiter:  NewLimiter(),
+type ListenerOption func(*limitedListener)
+
+// WithMaxConns is a listener option that caps the number of concurrent
+// connections. The excess connections are left in the listen backlog,
+// unless WithRejectExcess is used.
+func WithMaxConns(n int) ListenerOption {
+	return func(l *limitedListener) {
+		l.maxConns = n
+	}
+}
+
+// WithMaxConnsPerIP is a listener option that caps the number
+// of concurrent connections from a single remote IP address. The excess
+// connections are queued, until one of the connections from the same
+// address gets closed, unless WithRejectExcess is used. Up to 128
+// connections are queued per address, the ones over it are closed.
+func WithMaxConnsPerIP(n int) ListenerOption {
+	return func(l *limitedListener) {
+		l.maxConnsPerIP = n
+	}
+}
+
+// WithAcceptRate is a listener option that limits the rate
+// of accepting the connections, in connections per second.
+func WithAcceptRate(limit rate.Limit) ListenerOption {
+	return func(l *limitedListener) {
+		l.acceptLimiter = rate.NewLimiter(limit, 1)
+	}
+}
+
+// WithRejectExcess is a listener option that makes the listener close
+// the connections over the caps right after accepting them, instead
+// of queueing them.
+func WithRejectExcess() ListenerOption {
+	return func(l *limitedListener) {
+		l.reject = true
+	}
+}
+
+// WithDrain is a listener option that makes Close drain the listener
+// gracefully: after it stops accepting the connections, it waits
+// for the accepted ones to close, up to the timeout, before closing
+// the remaining ones.
+func WithDrain(timeout time.Duration) ListenerOption {
+	return func(l *limitedListener) {
+		l.drain = timeout
+	}
+}
+
+// WithListenerLimiter is a listener option that makes the listener
+// use the given Limiter, instead of a new one.
+func WithListenerLimiter(limiter *Limiter) ListenerOption {
+	return func(l *limitedListener) {
+		l.limiter = limiter
+	}
+}
+
+func NewListener(l net.Listener, opts ...ListenerOption) LimitedListener {
+	ret := &limitedListener{
+		Listener:     l,
+		results:      make(chan acceptResult),
+		done:         make(chan struct{}),
+		released:     make(chan struct{}, 1),
+		perIP:        make(map[string]int),
+		waitingPerIP: make(map[string]int),
+		accepted:     make(map[Conn]struct{}),
+		drained:      make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	if ret.limiter == nil {
+		ret.limiter = NewLimiter()
 	}
+	return ret
 }
@@ -0,0 +1,187 @@
+package tcplimit_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ksinica/tcplimit"
+	"github.com/ksinica/tcplimit/internal/pkg/mock"
+)
+
+func dialFrom(l *mock.Listener, ip string) net.Conn {
+	conn := mock.NewRemoteAddrConn(mock.NewNoopConn(), &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234})
+	go l.Dial(conn)
+	return conn
+}
+
+// acceptAll accepts the connections in the background,
+// until the listener gets closed.
+func acceptAll(l net.Listener) <-chan net.Conn {
+	ret := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ret <- conn
+		}
+	}()
+	return ret
+}
+
+func acceptWithin(accepted <-chan net.Conn, d time.Duration) net.Conn {
+	select {
+	case conn := <-accepted:
+		return conn
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func TestListenerMaxConnsPerIP(t *testing.T) {
+	ml := mock.NewListener()
+	l := tcplimit.NewListener(ml, tcplimit.WithMaxConnsPerIP(1))
+	defer l.Close()
+	accepted := acceptAll(l)
+
+	dialFrom(ml, "10.0.0.1")
+	first := acceptWithin(accepted, time.Second)
+	if first == nil {
+		t.Fatal("expected the first connection to be accepted")
+	}
+
+	// The second connection from the same address waits,
+	// while the ones from other addresses don't.
+	dialFrom(ml, "10.0.0.1")
+	dialFrom(ml, "10.0.0.2")
+	other := acceptWithin(accepted, time.Second)
+	if other == nil || other.RemoteAddr().String() != "10.0.0.2:1234" {
+		t.Fatalf("expected the connection from the other address, got %v", other)
+	}
+	if conn := acceptWithin(accepted, 50*time.Millisecond); conn != nil {
+		t.Fatal("expected the excess connection to wait")
+	}
+
+	// Closing the connection releases its slot.
+	first.Close()
+	if conn := acceptWithin(accepted, time.Second); conn == nil {
+		t.Fatal("expected the waiting connection to be accepted")
+	}
+}
+
+func TestListenerMaxConnsPerIPQueueFull(t *testing.T) {
+	ml := mock.NewListener()
+	l := tcplimit.NewListener(ml, tcplimit.WithMaxConnsPerIP(1))
+	defer l.Close()
+	accepted := acceptAll(l)
+
+	dialFrom(ml, "10.0.0.1")
+	if conn := acceptWithin(accepted, time.Second); conn == nil {
+		t.Fatal("expected the first connection to be accepted")
+	}
+
+	// Once the queue of the address is full, its excess connections
+	// are closed, while the ones from other addresses are accepted.
+	var excess net.Conn
+	for i := 0; i < 129; i++ {
+		excess = mock.NewRemoteAddrConn(mock.NewNoopConn(), &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		ml.Dial(excess)
+	}
+	dialFrom(ml, "10.0.0.2")
+	other := acceptWithin(accepted, time.Second)
+	if other == nil || other.RemoteAddr().String() != "10.0.0.2:1234" {
+		t.Fatalf("expected the connection from the other address, got %v", other)
+	}
+	if _, err := excess.Write(make([]byte, 1)); err == nil {
+		t.Error("expected the excess connection to be closed")
+	}
+}
+
+func TestListenerRejectExcess(t *testing.T) {
+	ml := mock.NewListener()
+	l := tcplimit.NewListener(ml, tcplimit.WithMaxConns(1), tcplimit.WithRejectExcess())
+	defer l.Close()
+	accepted := acceptAll(l)
+
+	dialFrom(ml, "10.0.0.1")
+	first := acceptWithin(accepted, time.Second)
+	if first == nil {
+		t.Fatal("expected the first connection to be accepted")
+	}
+
+	excess := dialFrom(ml, "10.0.0.2")
+	if conn := acceptWithin(accepted, 50*time.Millisecond); conn != nil {
+		t.Fatal("expected the excess connection to be rejected")
+	}
+	if _, err := excess.Write(make([]byte, 1)); err == nil {
+		t.Error("expected the excess connection to be closed")
+	}
+
+	first.Close()
+	dialFrom(ml, "10.0.0.2")
+	if conn := acceptWithin(accepted, time.Second); conn == nil {
+		t.Fatal("expected the connection to be accepted")
+	}
+}
+
+func TestListenerAcceptRate(t *testing.T) {
+	// The listener keeps accepting in the background.
+	var slept atomic.Int64
+	ml := mock.NewListener()
+	l := tcplimit.NewListener(
+		ml,
+		tcplimit.WithAcceptRate(2),
+		tcplimit.WithListenerLimiter(tcplimit.NewLimiter(
+			tcplimit.WithClock(&mock.Clock{
+				OnNow: time.Now,
+				OnSleep: func(d time.Duration) {
+					slept.Add(int64(d))
+				},
+			}),
+		)),
+	)
+	defer l.Close()
+	accepted := acceptAll(l)
+
+	for i := 0; i < 3; i++ {
+		dialFrom(ml, "10.0.0.1")
+		if conn := acceptWithin(accepted, time.Second); conn == nil {
+			t.Fatal("expected the connection to be accepted")
+		}
+	}
+	// The first connection fits in the burst, then the accept rate
+	// allows a connection every half a second.
+	if d := time.Duration(slept.Load()); d < 900*time.Millisecond {
+		t.Errorf("expected accepting to be throttled for %s, got %s", time.Second, d)
+	}
+}
+
+func TestListenerDrain(t *testing.T) {
+	ml := mock.NewListener()
+	l := tcplimit.NewListener(ml, tcplimit.WithDrain(50*time.Millisecond))
+	accepted := acceptAll(l)
+
+	dialFrom(ml, "10.0.0.1")
+	first := acceptWithin(accepted, time.Second)
+	dialFrom(ml, "10.0.0.2")
+	second := acceptWithin(accepted, time.Second)
+	if first == nil || second == nil {
+		t.Fatal("expected the connections to be accepted")
+	}
+	first.Close()
+
+	// The connection still open is closed once the drain times out.
+	start := time.Now()
+	if err := l.Close(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expected closing to wait for the connection, waited %s", d)
+	}
+	if _, err := second.Write(make([]byte, 1)); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
@@ -0,0 +1,215 @@
+package tcplimit
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMTU is the default size of the segments delivered
+	// by the emulated link.
+	defaultMTU = 1500
+	// linkQueueLen is the number of segments the emulated link holds
+	// in flight, before the writes start blocking.
+	linkQueueLen = 1024
+	// linkFlushTimeout is how long closing the emulated link waits
+	// for the segments in flight, past the due time of the last one.
+	linkFlushTimeout = time.Second
+)
+
+// netem are the parameters of the emulated link.
+type netem struct {
+	latency time.Duration
+	jitter  time.Duration
+	mtu     int
+}
+
+// enabled tells whether the link emulation is needed at all.
+func (n netem) enabled() bool {
+	return n.latency > 0 || n.jitter > 0 || n.mtu > 0
+}
+
+// segment is a part of the written data, due to be delivered at a time.
+type segment struct {
+	b   []byte
+	due time.Time
+}
+
+// link emulates the delivery of the written data over a network link,
+// delaying the segments by the link's latency, in order.
+type link struct {
+	conn     net.Conn
+	clock    Clock
+	config   netem
+	segments chan segment
+	done     chan struct{}
+	// mu guards the segments channel from being closed while sending.
+	mu     sync.RWMutex
+	closed bool
+	// stateMu guards the state of the delivery.
+	stateMu sync.Mutex
+	// last is the due time of the last segment sent.
+	last time.Time
+	err  error
+}
+
+func newLink(conn net.Conn, clock Clock, config netem) *link {
+	if config.mtu <= 0 {
+		config.mtu = defaultMTU
+	}
+
+	ret := &link{
+		conn:     conn,
+		clock:    clock,
+		config:   config,
+		segments: make(chan segment, linkQueueLen),
+		done:     make(chan struct{}),
+	}
+	go ret.run()
+	return ret
+}
+
+// send queues p for the delivery, split into the segments. It blocks,
+// when the link is full, until the context is done or the connection
+// gets closed. Returns the error of a delivery failed so far, if any.
+func (l *link) send(ctx context.Context, closed <-chan struct{},
+	p []byte) (n int, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return 0, net.ErrClosed
+	}
+
+	for n < len(p) {
+		size := min(len(p)-n, l.config.mtu)
+		seg, err := l.segment(p[n : n+size])
+		if err != nil {
+			return n, err
+		}
+
+		select {
+		case l.segments <- seg:
+			n += size
+		case <-closed:
+			return n, net.ErrClosed
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+	}
+	return
+}
+
+// segment copies b into a new segment, which is due after the latency
+// (with the jitter), but not before the segments sent earlier.
+func (l *link) segment(b []byte) (segment, error) {
+	var delay time.Duration
+	if l.config.jitter > 0 {
+		delay = time.Duration(rand.Int63n(int64(2*l.config.jitter))) - l.config.jitter
+	}
+	now := l.clock.Now()
+	due := now.Add(max(l.config.latency+delay, 0))
+
+	l.stateMu.Lock()
+	defer l.stateMu.Unlock()
+
+	if l.err != nil {
+		return segment{}, l.err
+	}
+	if due.Before(l.last) {
+		due = l.last
+	}
+	l.last = due
+	return segment{b: append([]byte(nil), b...), due: due}, nil
+}
+
+// run delivers the segments when they are due, until the link is closed.
+// After a failed delivery, the remaining segments are discarded.
+func (l *link) run() {
+	defer close(l.done)
+
+	for seg := range l.segments {
+		if l.failed() {
+			continue
+		}
+
+		if d := seg.due.Sub(l.clock.Now()); d > 0 {
+			elapsed, _ := l.clock.NewTimer(d)
+			<-elapsed
+		}
+		if _, err := l.conn.Write(seg.b); err != nil {
+			l.stateMu.Lock()
+			l.err = err
+			l.stateMu.Unlock()
+		}
+	}
+}
+
+func (l *link) failed() bool {
+	l.stateMu.Lock()
+	defer l.stateMu.Unlock()
+	return l.err != nil
+}
+
+// close stops accepting new segments, and waits for the ones in flight
+// to be delivered. A peer not reading could block the delivery forever,
+// so once the flush timeout passes, the underlying connection is closed,
+// discarding the segments left. The timeout is measured in real time,
+// as it guards the delivery, rather than emulating the link.
+func (l *link) close() {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.segments)
+	}
+	l.mu.Unlock()
+
+	l.stateMu.Lock()
+	pending := max(l.last.Sub(l.clock.Now()), 0)
+	l.stateMu.Unlock()
+
+	timer := time.NewTimer(pending + linkFlushTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-l.done:
+	case <-timer.C:
+		l.conn.Close()
+		<-l.done
+	}
+}
+
+// WithLatency is a Limiter option that delays the delivery of the data
+// written to the connections by the one-way latency, emulating a network
+// link. Along with the limits, it allows to model the bandwidth-delay
+// product. The writes return as soon as the data is queued for
+// the delivery, unless the link is full, and the errors of the delivery
+// are returned by the subsequent writes. Closing a connection waits
+// for the data in flight to be delivered, but no longer than a second
+// past its due time.
+func WithLatency(latency time.Duration) LimiterOption {
+	return func(l *Limiter) {
+		l.netem.latency = latency
+	}
+}
+
+// WithJitter is a Limiter option that varies the latency of the emulated
+// link (see WithLatency) randomly, within ±jitter. The order of the data
+// is preserved nonetheless.
+func WithJitter(jitter time.Duration) LimiterOption {
+	return func(l *Limiter) {
+		l.netem.jitter = jitter
+	}
+}
+
+// WithMTU is a Limiter option that sets the maximum size of the segments
+// delivered by the emulated link (see WithLatency). By default,
+// it is 1500 bytes.
+func WithMTU(mtu int) LimiterOption {
+	return func(l *Limiter) {
+		l.netem.mtu = mtu
+	}
+}
@@ -0,0 +1,193 @@
+package tcplimit
+
+import (
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// copyBufferSize is the size of the buffers used by ReadFrom
+	// and WriteTo, which is the same as io.Copy uses.
+	copyBufferSize = 32 * 1024
+)
+
+var copyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// closeWriter is implemented by the connections, which can shut down
+// their writing side, e.g. *net.TCPConn, *net.UnixConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeReader is implemented by the connections, which can shut down
+// their reading side, e.g. *net.TCPConn and *net.UnixConn.
+type closeReader interface {
+	CloseRead() error
+}
+
+// tcpOptions are the socket options of *net.TCPConn.
+type tcpOptions interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+	SetLinger(sec int) error
+	SetNoDelay(noDelay bool) error
+}
+
+// closeWriteConn is a conn exposing CloseWrite of the underlying
+// connection, e.g. of *tls.Conn.
+type closeWriteConn struct {
+	*conn
+}
+
+func (c *closeWriteConn) CloseWrite() error {
+	return c.closeWrite()
+}
+
+// unixConn is a conn exposing the optional interfaces of the underlying
+// connection shaped like *net.UnixConn.
+type unixConn struct {
+	*conn
+}
+
+func (c *unixConn) CloseWrite() error {
+	return c.closeWrite()
+}
+
+func (c *unixConn) CloseRead() error {
+	return c.Conn.(closeReader).CloseRead()
+}
+
+// SyscallConn returns the raw connection, whose I/O is not limited.
+func (c *unixConn) SyscallConn() (syscall.RawConn, error) {
+	return c.Conn.(syscall.Conn).SyscallConn()
+}
+
+// tcpConn is a conn exposing the optional interfaces of the underlying
+// connection shaped like *net.TCPConn.
+type tcpConn struct {
+	unixConn
+}
+
+func (c *tcpConn) SetKeepAlive(keepalive bool) error {
+	return c.Conn.(tcpOptions).SetKeepAlive(keepalive)
+}
+
+func (c *tcpConn) SetKeepAlivePeriod(d time.Duration) error {
+	return c.Conn.(tcpOptions).SetKeepAlivePeriod(d)
+}
+
+func (c *tcpConn) SetLinger(sec int) error {
+	return c.Conn.(tcpOptions).SetLinger(sec)
+}
+
+func (c *tcpConn) SetNoDelay(noDelay bool) error {
+	return c.Conn.(tcpOptions).SetNoDelay(noDelay)
+}
+
+// expose returns the Conn handing out the conn, which implements
+// the optional interfaces of the underlying connection (if any).
+// The connections implementing only some of the interfaces of *net.TCPConn
+// (or *net.UnixConn) expose the ones of the closest match.
+func expose(c *conn) Conn {
+	_, cw := c.Conn.(closeWriter)
+	_, cr := c.Conn.(closeReader)
+	_, sc := c.Conn.(syscall.Conn)
+	_, tcp := c.Conn.(tcpOptions)
+
+	switch {
+	case cw && cr && sc && tcp:
+		return &tcpConn{unixConn{c}}
+	case cw && cr && sc:
+		return &unixConn{c}
+	case cw:
+		return &closeWriteConn{c}
+	}
+	return c
+}
+
+// innerConn returns the conn behind the Conn, if it's wrapped
+// by a Limiter.
+func innerConn(c Conn) (*conn, bool) {
+	if c, ok := c.(interface{ self() *conn }); ok {
+		return c.self(), true
+	}
+	return nil, false
+}
+
+func (c *conn) self() *conn {
+	return c
+}
+
+// closeWrite shuts down the writing side of the underlying connection,
+// once the data in flight (see WithLatency) is delivered, or the flush
+// times out.
+func (c *conn) closeWrite() error {
+	if c.link != nil {
+		c.link.close()
+	}
+	return c.Conn.(closeWriter).CloseWrite()
+}
+
+func (c *conn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// ReadFrom reads from r until EOF, writing the data to the connection,
+// as throttled as Write. It lets io.Copy reuse the buffers, instead of
+// allocating its own.
+func (c *conn) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	for {
+		nr, er := r.Read(*buf)
+		if nr > 0 {
+			nw, ew := c.Write((*buf)[:nr])
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+		}
+		if er != nil {
+			if er == io.EOF {
+				return n, nil
+			}
+			return n, er
+		}
+	}
+}
+
+// WriteTo reads from the connection until EOF, writing the data to w,
+// as throttled as Read. See ReadFrom for more information.
+func (c *conn) WriteTo(w io.Writer) (n int64, err error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	for {
+		nr, er := c.Read(*buf)
+		if nr > 0 {
+			nw, ew := w.Write((*buf)[:nr])
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+			if nw < nr {
+				return n, io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er == io.EOF {
+				return n, nil
+			}
+			return n, er
+		}
+	}
+}
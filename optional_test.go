@@ -0,0 +1,119 @@
+package tcplimit_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ksinica/tcplimit"
+	"github.com/ksinica/tcplimit/internal/pkg/mock"
+	"golang.org/x/time/rate"
+)
+
+func TestConnOptionalInterfaces(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	tc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	conn := tcplimit.NewLimiter().LimitConn(tc)
+	defer conn.Close()
+
+	peer, ok := <-accepted
+	if !ok {
+		t.Fatal("expected the connection to be accepted")
+	}
+	defer peer.Close()
+
+	if conn.Unwrap() != tc {
+		t.Error("expected Unwrap to return the underlying connection")
+	}
+	if _, ok := conn.(syscall.Conn); !ok {
+		t.Error("expected the connection to implement syscall.Conn")
+	}
+	if nd, ok := conn.(interface{ SetNoDelay(bool) error }); !ok {
+		t.Error("expected the connection to implement SetNoDelay")
+	} else if err := nd.SetNoDelay(false); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// The peer should see EOF, while the other direction keeps working.
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("expected the connection to implement CloseWrite")
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected %v, got %v", io.EOF, err)
+	}
+	if _, err := peer.Write([]byte("ok")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if b, err := io.ReadAll(io.LimitReader(conn, 2)); err != nil || string(b) != "ok" {
+		t.Errorf("expected %q, got %q (%v)", "ok", b, err)
+	}
+}
+
+func TestConnNoOptionalInterfaces(t *testing.T) {
+	conn := tcplimit.NewLimiter().LimitConn(mock.NewNoopConn())
+	defer conn.Close()
+
+	if _, ok := conn.(interface{ CloseWrite() error }); ok {
+		t.Error("expected the connection not to implement CloseWrite")
+	}
+	if _, ok := conn.(syscall.Conn); ok {
+		t.Error("expected the connection not to implement syscall.Conn")
+	}
+}
+
+func TestConnReadFrom(t *testing.T) {
+	var slept time.Duration
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithLocalLimit(rate.Limit(1024)),
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+			OnSleep: func(d time.Duration) {
+				slept += d
+				now = now.Add(d)
+			},
+		}),
+	)
+
+	var buf bytes.Buffer
+	w := limiter.LimitWriter(&buf)
+	defer w.Close()
+
+	rf, ok := w.(io.ReaderFrom)
+	if !ok {
+		t.Fatal("expected the connection to implement io.ReaderFrom")
+	}
+	if n, err := rf.ReadFrom(bytes.NewReader(make([]byte, 2048))); err != nil || n != 2048 {
+		t.Fatalf("expected %d bytes written, got %d (%v)", 2048, n, err)
+	}
+	if slept != time.Second {
+		t.Errorf("expected write to be throttled for %s, got %s", time.Second, slept)
+	}
+}
@@ -0,0 +1,274 @@
+package tcplimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// errPacketConn is returned by the stream methods of a wrapped packet
+// connection, which are not a part of its interface.
+var errPacketConn = errors.New("stream operation on a packet connection")
+
+// PacketConn is a generic packet-oriented network connection, enriched
+// by the ability to set bandwidth limits. The datagrams are charged against
+// the same global and local limits as the stream-oriented connections.
+//
+// Datagrams are never split, so each of them is let through once
+// the limiters are out of debt, being charged for its full size
+// afterwards. This way, the datagrams larger than the burst are still
+// delivered, while the limits hold on average. By default, a datagram
+// arriving while any of the limiters is in debt is delayed, but it can
+// also be dropped (see WithPacketDrop).
+//
+// The datagrams are not queued by the fair sharing (see WithFairSharing),
+// but still count against the global limits. Neither the link emulation,
+// nor the faults (except for CloseAfter) apply to the datagrams.
+//
+// Multiple goroutines may invoke methods on a PacketConn simultaneously.
+type PacketConn interface {
+	net.PacketConn
+
+	// ReadFromContext acts like ReadFrom, but stops waiting for
+	// the bandwidth when the context is done, returning the context's
+	// error.
+	ReadFromContext(ctx context.Context, p []byte) (n int, addr net.Addr, err error)
+	// WriteToContext acts like WriteTo, but stops waiting for
+	// the bandwidth when the context is done, returning the context's
+	// error.
+	WriteToContext(ctx context.Context, p []byte, addr net.Addr) (n int, err error)
+
+	// SetLimit sets a new Limit for both read and write directions.
+	// See Conn.SetLimit for more information.
+	SetLimit(limit rate.Limit) error
+	// Limit returns the current Limit. When read and write limits differ,
+	// the lower of them is returned.
+	Limit() rate.Limit
+	// SetReadLimit sets a new Limit for the read direction only.
+	SetReadLimit(limit rate.Limit) error
+	// ReadLimit returns the current read Limit.
+	ReadLimit() rate.Limit
+	// SetWriteLimit sets a new Limit for the write direction only.
+	SetWriteLimit(limit rate.Limit) error
+	// WriteLimit returns the current write Limit.
+	WriteLimit() rate.Limit
+	// ResetLimit makes the connection inherit the local limits
+	// of the Limiter again.
+	ResetLimit()
+	// Stats returns the connection's traffic statistics.
+	Stats() ConnStats
+	// ID returns the connection's identifier, unique within its Limiter.
+	ID() uint64
+	// SetLabel sets the user-defined label of the connection.
+	// See Conn.SetLabel for more information.
+	SetLabel(key, value string)
+	// Labels returns a copy of the connection's labels.
+	Labels() map[string]string
+}
+
+// packetAdapter lets a packet connection be wrapped like a stream one.
+type packetAdapter struct {
+	net.PacketConn
+}
+
+func (packetAdapter) Read([]byte) (int, error) {
+	return 0, errPacketConn
+}
+
+func (packetAdapter) Write([]byte) (int, error) {
+	return 0, errPacketConn
+}
+
+func (packetAdapter) RemoteAddr() net.Addr {
+	return nil
+}
+
+type packetConn struct {
+	*conn
+
+	pc   net.PacketConn
+	drop bool
+}
+
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	return c.ReadFromContext(context.Background(), p)
+}
+
+func (c *packetConn) ReadFromContext(ctx context.Context, p []byte) (n int, addr net.Addr, err error) {
+	for {
+		var dropped bool
+		n, dropped, err = c.doPacket(ctx, c.read, &c.readDeadline, 0, func() (int, error) {
+			var n int
+			n, addr, err = c.pc.ReadFrom(p)
+			return n, err
+		})
+		// A dropped datagram is as good as never received,
+		// so we go for the next one.
+		if !dropped {
+			break
+		}
+	}
+	c.stats.addRead(n)
+	return
+}
+
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.WriteToContext(context.Background(), p, addr)
+}
+
+func (c *packetConn) WriteToContext(ctx context.Context, p []byte, addr net.Addr) (n int, err error) {
+	n, dropped, err := c.doPacket(ctx, c.write, &c.writeDeadline, len(p), func() (int, error) {
+		return c.pc.WriteTo(p, addr)
+	})
+	if dropped {
+		// Just like a router would, we pretend the datagram was sent.
+		return len(p), nil
+	}
+	c.stats.addWritten(n)
+	return
+}
+
+// doPacket transfers a single datagram with f, as soon as the limiters
+// are out of debt, charging them for its full size afterwards. In the drop
+// mode, it drops the datagram instead of waiting for the bandwidth.
+// The size of the datagram is known upfront only when sending, so zero
+// means that the datagram is being received.
+func (c *packetConn) doPacket(ctx context.Context, b buckets, dl *deadline,
+	size int, f func() (int, error)) (n int, dropped bool, err error) {
+	limiters := b.all()
+	if b.sched != nil {
+		limiters = append(limiters, b.sched.lim)
+	}
+
+	for _, u := range b.usages {
+		u.check(c.clock.Now())
+	}
+
+	if len(b.quotas) > 0 && size > 0 {
+		if granted := takeQuotas(b.quotas, c.clock.Now(), size); granted < size {
+			giveQuotas(b.quotas, c.clock.Now(), granted)
+			return 0, false, ErrQuotaExceeded
+		}
+		defer func() {
+			giveQuotas(b.quotas, c.clock.Now(), size-n)
+		}()
+	}
+
+	// In the drop mode, a datagram has to be received before
+	// it can be dropped.
+	received := c.drop && size == 0
+	if received {
+		if n, err = f(); err != nil {
+			return
+		}
+	}
+
+	if err = c.admit(ctx, limiters, dl); err != nil {
+		if err == errPacketDropped {
+			c.stats.addDropped()
+			return 0, true, nil
+		}
+		return 0, false, err
+	}
+
+	if !received {
+		n, err = f()
+	}
+	if n == 0 {
+		return
+	}
+
+	now := c.clock.Now()
+	if len(b.quotas) > 0 && size == 0 {
+		// A datagram over the quota is lost, as it cannot be split.
+		if granted := takeQuotas(b.quotas, now, n); granted < n {
+			giveQuotas(b.quotas, now, granted)
+			return 0, false, ErrQuotaExceeded
+		}
+	}
+	for _, lim := range limiters {
+		chargeN(lim, now, n)
+	}
+	for _, u := range b.usages {
+		u.add(now, n)
+	}
+	return
+}
+
+// errPacketDropped means that the datagram is over the limit
+// in the drop mode.
+var errPacketDropped = errors.New("packet dropped")
+
+// admit waits until all of the limiters are out of debt. In the drop mode,
+// it returns errPacketDropped instead of waiting.
+func (c *packetConn) admit(ctx context.Context, limiters []*rate.Limiter,
+	dl *deadline) error {
+	for _, lim := range limiters {
+		if lim.Limit() == 0 {
+			if c.drop {
+				return errPacketDropped
+			}
+			return ErrUnfulfillableReservation
+		}
+	}
+
+	var throttled bool
+	start := c.clock.Now()
+	for {
+		// Reserving nothing tells how long it takes to get out of debt.
+		now := c.clock.Now()
+		reservations, err := reserveN(limiters, now, 0)
+		if err != nil {
+			return err
+		}
+		var delay time.Duration
+		for _, r := range reservations {
+			delay = max(delay, r.DelayFrom(now))
+		}
+		if delay <= 0 {
+			break
+		}
+		if c.drop {
+			return errPacketDropped
+		}
+
+		throttled = true
+		if _, err := c.wait(ctx, delay, dl, nil); err != nil {
+			return err
+		}
+	}
+
+	if throttled {
+		c.stats.addThrottling(c.clock.Now().Sub(start))
+	}
+	return nil
+}
+
+type PacketConnOption func(*packetConn)
+
+// WithPacketDrop is a PacketConn option that makes the connection drop
+// the datagrams over the limit, instead of delaying them, which is how
+// the real routers behave. The dropped datagrams are counted by
+// the connection's statistics.
+func WithPacketDrop() PacketConnOption {
+	return func(c *packetConn) {
+		c.drop = true
+	}
+}
+
+// LimitPacketConn wraps the given packet connection into
+// a bandwidth-limited connection. See PacketConn for more information.
+func (l *Limiter) LimitPacketConn(pc net.PacketConn, opts ...PacketConnOption) PacketConn {
+	conn, _ := innerConn(l.limitConn(packetAdapter{pc}, l.root, l.deleteConn))
+	ret := &packetConn{
+		conn: conn,
+		pc:   pc,
+	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret
+}
@@ -0,0 +1,90 @@
+package tcplimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ksinica/tcplimit"
+	"github.com/ksinica/tcplimit/internal/pkg/mock"
+	"golang.org/x/time/rate"
+)
+
+func TestPacketConnDelay(t *testing.T) {
+	var slept time.Duration
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithLocalLimit(rate.Limit(1024)),
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+			OnSleep: func(d time.Duration) {
+				slept += d
+				now = now.Add(d)
+			},
+		}),
+	)
+
+	conn := limiter.LimitPacketConn(mock.NewNoopPacketConn())
+	defer conn.Close()
+
+	// A datagram larger than the burst is not split...
+	if n, err := conn.WriteTo(make([]byte, 3*1024), nil); err != nil || n != 3*1024 {
+		t.Fatalf("expected %d bytes written, got %d (%v)", 3*1024, n, err)
+	}
+	if slept != 0 {
+		t.Errorf("expected no throttling, got %s", slept)
+	}
+	// ...but the next one waits for the limiter to get out of debt.
+	if _, err := conn.WriteTo(make([]byte, 100), nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if slept != 2*time.Second {
+		t.Errorf("expected write to be throttled for %s, got %s", 2*time.Second, slept)
+	}
+
+	// The directions are limited independently.
+	if n, _, err := conn.ReadFrom(make([]byte, 3*1024)); err != nil || n != 3*1024 {
+		t.Fatalf("expected %d bytes read, got %d (%v)", 3*1024, n, err)
+	}
+	if slept != 2*time.Second {
+		t.Errorf("expected read not to be throttled, got %s", slept-2*time.Second)
+	}
+}
+
+func TestPacketConnDrop(t *testing.T) {
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithLocalLimit(rate.Limit(1024)),
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+		}),
+	)
+
+	conn := limiter.LimitPacketConn(mock.NewNoopPacketConn(), tcplimit.WithPacketDrop())
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		if n, err := conn.WriteTo(make([]byte, 1024), nil); err != nil || n != 1024 {
+			t.Fatalf("expected %d bytes written, got %d (%v)", 1024, n, err)
+		}
+	}
+
+	// The first datagram empties the bucket, the second one puts it
+	// into debt, so the third one gets dropped.
+	stats := conn.Stats()
+	if stats.BytesWritten != 2*1024 || stats.Dropped != 1 {
+		t.Errorf("expected two datagrams written and one dropped, got %+v", stats)
+	}
+
+	// Once out of debt, the datagrams are let through again.
+	now = now.Add(time.Second)
+	if _, err := conn.WriteTo(make([]byte, 1024), nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if got := limiter.Stats(); got.BytesWritten != 3*1024 || got.Dropped != 1 {
+		t.Errorf("expected three datagrams written and one dropped, got %+v", got)
+	}
+}
@@ -0,0 +1,172 @@
+package tcplimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// UnlimitedQuota is a quota, which never gets exceeded.
+const UnlimitedQuota int64 = math.MaxInt64
+
+// quota caps the number of bytes transferred (in both directions)
+// within a period, after which the usage is reset.
+type quota struct {
+	mu sync.Mutex
+	// bytes is the cap for a single period.
+	bytes int64
+	// period is the duration of a period, zero meaning that the usage
+	// is never reset.
+	period time.Duration
+	// start is the start of the current period.
+	start time.Time
+	used  int64
+	// extra are the bytes topped up for the current period.
+	extra int64
+}
+
+func newQuota(bytes int64, period time.Duration, now time.Time) *quota {
+	return &quota{
+		bytes:  bytes,
+		period: period,
+		start:  now,
+	}
+}
+
+// advance resets the usage, when the current period is over.
+// The mutex is expected to be held.
+func (q *quota) advance(now time.Time) {
+	if q.period <= 0 {
+		return
+	}
+	if elapsed := now.Sub(q.start); elapsed >= q.period {
+		q.start = q.start.Add(elapsed / q.period * q.period)
+		q.used = 0
+		q.extra = 0
+	}
+}
+
+// left returns the number of bytes left in the current period.
+// The mutex is expected to be held.
+func (q *quota) left() int64 {
+	if q.bytes == UnlimitedQuota {
+		return UnlimitedQuota
+	}
+	return max(addSaturated(q.bytes, q.extra)-q.used, 0)
+}
+
+func (q *quota) remaining(now time.Time) (ret int64) {
+	q.mu.Lock()
+	q.advance(now)
+	ret = q.left()
+	q.mu.Unlock()
+	return
+}
+
+// take takes up to n bytes from the quota, returning how many of them
+// were granted.
+func (q *quota) take(now time.Time, n int) int {
+	q.mu.Lock()
+	q.advance(now)
+	n = int(min(int64(n), q.left()))
+	q.used += int64(n)
+	q.mu.Unlock()
+	return n
+}
+
+// use takes n bytes already transferred from the quota, even if it
+// overruns the quota.
+func (q *quota) use(now time.Time, n int) {
+	q.mu.Lock()
+	q.advance(now)
+	q.used += int64(n)
+	q.mu.Unlock()
+}
+
+// give gives back n bytes taken, but not transferred.
+func (q *quota) give(now time.Time, n int) {
+	q.mu.Lock()
+	q.advance(now)
+	// The period may have been reset in the meantime,
+	// so the usage must not go below zero.
+	q.used = max(q.used-int64(n), 0)
+	q.mu.Unlock()
+}
+
+// set changes the cap and the period, keeping the usage. A new period
+// starts, when the period is changed.
+func (q *quota) set(now time.Time, bytes int64, period time.Duration) {
+	q.mu.Lock()
+	q.advance(now)
+	if period != q.period {
+		q.start = now
+		q.period = period
+	}
+	q.bytes = bytes
+	q.mu.Unlock()
+}
+
+// topUp adds n bytes to the current period.
+func (q *quota) topUp(now time.Time, n int64) {
+	q.mu.Lock()
+	q.advance(now)
+	q.extra = addSaturated(q.extra, n)
+	q.mu.Unlock()
+}
+
+// takeQuotas takes up to n bytes from each of the quotas, so that all
+// of them grant the same number of bytes, which is returned.
+func takeQuotas(quotas []*quota, now time.Time, n int) int {
+	for i, q := range quotas {
+		granted := q.take(now, n)
+		if granted < n {
+			// The quotas taken so far get back the surplus.
+			giveQuotas(quotas[:i], now, n-granted)
+			n = granted
+		}
+	}
+	return n
+}
+
+// leftQuotas returns the lowest number of bytes left in the quotas.
+func leftQuotas(quotas []*quota, now time.Time) int64 {
+	ret := UnlimitedQuota
+	for _, q := range quotas {
+		ret = min(ret, q.remaining(now))
+	}
+	return ret
+}
+
+// useQuotas takes n bytes already transferred from each of the quotas.
+func useQuotas(quotas []*quota, now time.Time, n int) {
+	if n == 0 {
+		return
+	}
+	for _, q := range quotas {
+		q.use(now, n)
+	}
+}
+
+// giveQuotas gives back n bytes to each of the quotas.
+func giveQuotas(quotas []*quota, now time.Time, n int) {
+	if n == 0 {
+		return
+	}
+	for _, q := range quotas {
+		q.give(now, n)
+	}
+}
+
+// addSaturated adds two non-negative numbers, capping the result
+// to UnlimitedQuota instead of overflowing.
+func addSaturated(a, b int64) int64 {
+	if a > UnlimitedQuota-b {
+		return UnlimitedQuota
+	}
+	return a + b
+}
+
+// validQuota tells whether the quota's parameters are valid.
+func validQuota(bytes int64, period time.Duration) bool {
+	return bytes >= 0 && period >= 0
+}
@@ -0,0 +1,206 @@
+package tcplimit
+
+import (
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultRampStep is the default interval between the limit changes
+// made by a ramp.
+const defaultRampStep = 100 * time.Millisecond
+
+type rampConfig struct {
+	exponential bool
+	step        time.Duration
+}
+
+type RampOption func(*rampConfig)
+
+// WithExponentialRamp is a ramp option that makes the limit change
+// exponentially rather than linearly, i.e. by the same factor with every
+// step, which is gentler on the lower end of the ramp. The ramp is linear,
+// when the current limit or the target is zero.
+func WithExponentialRamp() RampOption {
+	return func(c *rampConfig) {
+		c.exponential = true
+	}
+}
+
+// WithRampStep is a ramp option that sets the interval between
+// the limit changes made by the ramp. By default, it is 100ms.
+func WithRampStep(step time.Duration) RampOption {
+	return func(c *rampConfig) {
+		if step > 0 {
+			c.step = step
+		}
+	}
+}
+
+// interpolate returns the limit at the fraction f of the ramp. A ramp
+// from or to an infinite limit has no meaningful interpolation, so it
+// switches to the target at the end.
+func (c *rampConfig) interpolate(from, to rate.Limit, f float64) rate.Limit {
+	switch {
+	case f >= 1:
+		return to
+	case from == rate.Inf || to == rate.Inf:
+		return from
+	case c.exponential && from > 0 && to > 0:
+		return from * rate.Limit(math.Pow(float64(to/from), f))
+	default:
+		return from + (to-from)*rate.Limit(f)
+	}
+}
+
+// rampTarget is a limit changed by a ramp.
+type rampTarget struct {
+	from rate.Limit
+	to   rate.Limit
+	set  func(rate.Limit)
+}
+
+// ramp is a ramp in progress.
+type ramp struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// RampGlobalLimit changes the global limit for both read and write
+// directions to the target gradually, over the duration d, instead
+// of making a step change, which could make the TCP senders collapse
+// or cause queue spikes. By default, the limit changes linearly, every
+// 100ms. A ramp from or to rate.Inf changes the limit at its end.
+//
+// The ramp replaces the global limit's ramp in progress, if any.
+// It gets cancelled by setting the global limit in the meantime.
+//
+// Returns ErrInvalidLimit when target is negative.
+func (l *Limiter) RampGlobalLimit(target rate.Limit, d time.Duration,
+	opts ...RampOption) error {
+	if target < 0 {
+		return ErrInvalidLimit
+	}
+
+	l.startRamp(&l.globalRamp, d, opts, []rampTarget{
+		{
+			from: l.GlobalReadLimit(),
+			to:   target,
+			set: func(limit rate.Limit) {
+				l.setGlobalLimit(l.globalReadLimiter, l.readScheduler, limit)
+			},
+		},
+		{
+			from: l.GlobalWriteLimit(),
+			to:   target,
+			set: func(limit rate.Limit) {
+				l.setGlobalLimit(l.globalWriteLimiter, l.writeScheduler, limit)
+			},
+		},
+	})
+	return nil
+}
+
+// RampLocalLimit changes the local limit for both read and write
+// directions to the target gradually, over the duration d.
+// See RampGlobalLimit for more information.
+//
+// The ramp replaces the local limit's ramp in progress, if any.
+// It gets cancelled by setting the local limit in the meantime.
+//
+// Returns ErrInvalidLimit when target is negative.
+func (l *Limiter) RampLocalLimit(target rate.Limit, d time.Duration,
+	opts ...RampOption) error {
+	if target < 0 {
+		return ErrInvalidLimit
+	}
+
+	l.startRamp(&l.localRamp, d, opts, []rampTarget{
+		{
+			from: l.LocalReadLimit(),
+			to:   target,
+			set:  l.setLocalReadLimit,
+		},
+		{
+			from: l.LocalWriteLimit(),
+			to:   target,
+			set:  l.setLocalWriteLimit,
+		},
+	})
+	return nil
+}
+
+// startRamp starts a ramp of the targets in place of the given one.
+func (l *Limiter) startRamp(r **ramp, d time.Duration, opts []RampOption,
+	targets []rampTarget) {
+	config := rampConfig{step: defaultRampStep}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	l.rampMu.Lock()
+	defer l.rampMu.Unlock()
+
+	l.stopRampLocked(r)
+	if d <= 0 {
+		for _, t := range targets {
+			t.set(t.to)
+		}
+		return
+	}
+
+	*r = &ramp{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go l.runRamp(*r, config, l.clock.Now(), d, targets)
+}
+
+// runRamp changes the targets' limits with every step, until the ramp
+// is over or gets stopped.
+func (l *Limiter) runRamp(r *ramp, config rampConfig, start time.Time,
+	d time.Duration, targets []rampTarget) {
+	defer close(r.done)
+
+	for {
+		elapsed, stopTimer := l.clock.NewTimer(config.step)
+		select {
+		case <-elapsed:
+		case <-r.stop:
+			stopTimer()
+			return
+		}
+
+		f := float64(l.clock.Now().Sub(start)) / float64(d)
+		for _, t := range targets {
+			t.set(config.interpolate(t.from, t.to, f))
+		}
+		if f >= 1 {
+			return
+		}
+	}
+}
+
+// stopRamp stops the ramp, if any, waiting for it to finish,
+// so that it doesn't overwrite the limit set afterwards.
+func (l *Limiter) stopRamp(r **ramp) {
+	l.rampMu.Lock()
+	l.stopRampLocked(r)
+	l.rampMu.Unlock()
+}
+
+// stopRampLocked acts like stopRamp, but expects the ramps' mutex
+// to be held.
+func (l *Limiter) stopRampLocked(r **ramp) {
+	if *r == nil {
+		return
+	}
+	select {
+	case <-(*r).done:
+	default:
+		close((*r).stop)
+		<-(*r).done
+	}
+	*r = nil
+}
@@ -0,0 +1,34 @@
+package tcplimit
+
+import (
+	"math"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRampInterpolate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		config   rampConfig
+		from     rate.Limit
+		to       rate.Limit
+		f        float64
+		expected rate.Limit
+	}{
+		{"linear", rampConfig{}, 100, 300, 0.5, 200},
+		{"linear down", rampConfig{}, 300, 100, 0.25, 250},
+		{"exponential", rampConfig{exponential: true}, 100, 10000, 0.5, 1000},
+		{"exponential from zero", rampConfig{exponential: true}, 0, 100, 0.5, 50},
+		{"from infinity", rampConfig{}, rate.Inf, 100, 0.5, rate.Inf},
+		{"to infinity", rampConfig{}, 100, rate.Inf, 0.5, 100},
+		{"end", rampConfig{}, rate.Inf, 100, 1, 100},
+		{"past end", rampConfig{}, 100, 300, 1.5, 300},
+	} {
+		got := test.config.interpolate(test.from, test.to, test.f)
+		if math.Abs(float64(got-test.expected)) > 1e-6 &&
+			!(got == rate.Inf && test.expected == rate.Inf) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package tcplimit
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// day is the length of a day, as far as the schedules are concerned.
+const day = 24 * time.Hour
+
+// ScheduleRule sets the limits during a daily time window.
+type ScheduleRule struct {
+	// Weekdays are the days the rule applies to, which is every day,
+	// when empty. A window wrapping past midnight belongs to the day
+	// it starts on.
+	Weekdays []time.Weekday
+	// Start and End are the offsets from midnight the window starts
+	// and ends at (exclusive). When End is not after Start, the window
+	// wraps past midnight, so Start equal to End means the whole day.
+	Start time.Duration
+	End   time.Duration
+	// GlobalLimit and LocalLimit are the limits set during the window.
+	// A zero limit means no limit (rate.Inf).
+	GlobalLimit rate.Limit
+	LocalLimit  rate.Limit
+}
+
+// Schedule switches the limits of a Limiter depending on the time of day,
+// e.g. to lower them during business hours.
+type Schedule struct {
+	// Rules are the rules of the Schedule, the first of the rules
+	// applying at the time taking precedence.
+	Rules []ScheduleRule
+	// GlobalLimit and LocalLimit are the limits set when none
+	// of the rules applies. A zero limit means no limit (rate.Inf).
+	GlobalLimit rate.Limit
+	LocalLimit  rate.Limit
+	// Location is the time zone of the rules, which is time.Local,
+	// when nil.
+	Location *time.Location
+}
+
+// valid tells whether the Schedule's limits and windows are valid.
+func (s *Schedule) valid() bool {
+	if s.GlobalLimit < 0 || s.LocalLimit < 0 {
+		return false
+	}
+	for _, r := range s.Rules {
+		if r.GlobalLimit < 0 || r.LocalLimit < 0 ||
+			r.Start < 0 || r.Start >= day || r.End < 0 || r.End > day {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Schedule) location() *time.Location {
+	if s.Location == nil {
+		return time.Local
+	}
+	return s.Location
+}
+
+// limitsAt returns the limits applying at the time t.
+func (s *Schedule) limitsAt(t time.Time) (global, local rate.Limit) {
+	t = t.In(s.location())
+	for _, r := range s.Rules {
+		if r.appliesAt(t) {
+			return orInf(r.GlobalLimit), orInf(r.LocalLimit)
+		}
+	}
+	return orInf(s.GlobalLimit), orInf(s.LocalLimit)
+}
+
+// orInf returns the limit, or rate.Inf, when it's left out (zero),
+// so that a Schedule cannot stop the traffic by accident.
+func orInf(limit rate.Limit) rate.Limit {
+	if limit == 0 {
+		return rate.Inf
+	}
+	return limit
+}
+
+// next returns the first boundary of the rules' windows after the time t,
+// or the zero time, when there are no rules.
+func (s *Schedule) next(t time.Time) (ret time.Time) {
+	t = t.In(s.location())
+	// Every window repeats at least weekly, so the boundaries
+	// of the next week are enough.
+	for i := 0; i <= 7; i++ {
+		midnight := time.Date(t.Year(), t.Month(), t.Day()+i, 0, 0, 0, 0,
+			t.Location())
+		for _, r := range s.Rules {
+			for _, boundary := range r.boundaries(midnight) {
+				if boundary.After(t) && (ret.IsZero() || boundary.Before(ret)) {
+					ret = boundary
+				}
+			}
+		}
+	}
+	return
+}
+
+// appliesAt tells whether the time t falls into the rule's window.
+func (r *ScheduleRule) appliesAt(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0,
+		t.Location())
+	offset := t.Sub(midnight)
+
+	if r.Start < r.End {
+		return r.appliesOn(t.Weekday()) && offset >= r.Start && offset < r.End
+	}
+	// The window wraps past midnight, so it might have started
+	// on the previous day.
+	return (r.appliesOn(t.Weekday()) && offset >= r.Start) ||
+		(r.appliesOn((t.Weekday()+6)%7) && offset < r.End)
+}
+
+// boundaries returns the times the rule's window starts or ends at
+// on the day starting at midnight.
+func (r *ScheduleRule) boundaries(midnight time.Time) (ret []time.Time) {
+	if r.appliesOn(midnight.Weekday()) {
+		ret = append(ret, midnight.Add(r.Start))
+	}
+	// A window wrapping past midnight ends on the next day.
+	started := midnight.Weekday()
+	if r.End <= r.Start {
+		started = (started + 6) % 7
+	}
+	if r.appliesOn(started) {
+		ret = append(ret, midnight.Add(r.End))
+	}
+	return
+}
+
+func (r *ScheduleRule) appliesOn(weekday time.Weekday) bool {
+	return len(r.Weekdays) == 0 || slices.Contains(r.Weekdays, weekday)
+}
+
+// SetSchedule makes the Limiter switch its global and local limits
+// (for both read and write directions) according to the Schedule,
+// replacing the current Schedule, if any. The limits are set right away,
+// and then at every boundary of the rules' windows, overwriting
+// the limits set in the meantime, including the separate read and write
+// limits, and cancelling the ramps in progress. A nil Schedule stops
+// switching the limits, leaving the current ones in place.
+//
+// Returns ErrInvalidSchedule when any of the limits is negative, or any
+// of the windows does not fit in a day.
+func (l *Limiter) SetSchedule(s *Schedule) error {
+	if s != nil && !s.valid() {
+		return ErrInvalidSchedule
+	}
+
+	l.scheduleMu.Lock()
+	defer l.scheduleMu.Unlock()
+
+	if l.scheduleStop != nil {
+		// Wait for the current Schedule to stop, so that it doesn't
+		// overwrite the limits of the new one.
+		close(l.scheduleStop)
+		<-l.scheduleDone
+		l.scheduleStop, l.scheduleDone = nil, nil
+	}
+	if s == nil {
+		return nil
+	}
+
+	// The Schedule is copied, so that it's not affected by the changes
+	// made by the caller.
+	s = &Schedule{
+		Rules:       slices.Clone(s.Rules),
+		GlobalLimit: s.GlobalLimit,
+		LocalLimit:  s.LocalLimit,
+		Location:    s.Location,
+	}
+
+	now := l.clock.Now()
+	l.applySchedule(s, now)
+	if next := s.next(now); !next.IsZero() {
+		l.scheduleStop = make(chan struct{})
+		l.scheduleDone = make(chan struct{})
+		go l.runSchedule(s, next, l.scheduleStop, l.scheduleDone)
+	}
+	return nil
+}
+
+// runSchedule sets the limits at the Schedule's boundaries,
+// starting with the next one, until stopped.
+func (l *Limiter) runSchedule(s *Schedule, next time.Time,
+	stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		elapsed, stopTimer := l.clock.NewTimer(next.Sub(l.clock.Now()))
+		select {
+		case <-elapsed:
+		case <-stop:
+			stopTimer()
+			return
+		}
+
+		// The timer might have fired a bit early.
+		now := l.clock.Now()
+		if now.Before(next) {
+			now = next
+		}
+		l.applySchedule(s, now)
+		next = s.next(now)
+	}
+}
+
+func (l *Limiter) applySchedule(s *Schedule, t time.Time) {
+	global, local := s.limitsAt(t)
+	l.SetGlobalLimit(global)
+	l.SetLocalLimit(local)
+}
+
+// WithSchedule is a Limiter option that makes the Limiter switch its limits
+// according to the Schedule. See SetSchedule for more information.
+// An invalid Schedule is ignored.
+func WithSchedule(s *Schedule) LimiterOption {
+	return func(l *Limiter) {
+		if s == nil || s.valid() {
+			l.schedule = s
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package tcplimit
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestSchedule(t *testing.T) {
+	s := &Schedule{
+		Rules: []ScheduleRule{
+			{
+				Weekdays:    []time.Weekday{time.Monday, time.Tuesday},
+				Start:       9 * time.Hour,
+				End:         17 * time.Hour,
+				GlobalLimit: rate.Limit(1024),
+				LocalLimit:  rate.Limit(100),
+			},
+			{
+				Weekdays:    []time.Weekday{time.Friday},
+				Start:       22 * time.Hour,
+				End:         2 * time.Hour,
+				GlobalLimit: rate.Limit(2048),
+				LocalLimit:  rate.Limit(200),
+			},
+		},
+		GlobalLimit: rate.Inf,
+		LocalLimit:  rate.Inf,
+		Location:    time.UTC,
+	}
+
+	// 2024-01-01 is a Monday.
+	at := func(day, hour int) time.Time {
+		return time.Date(2024, 1, day, hour, 0, 0, 0, time.UTC)
+	}
+
+	for _, test := range []struct {
+		name           string
+		t              time.Time
+		expectedGlobal rate.Limit
+		expectedLocal  rate.Limit
+		expectedNext   time.Time
+	}{
+		{"before window", at(1, 8), rate.Inf, rate.Inf, at(1, 9)},
+		{"window start", at(1, 9), 1024, 100, at(1, 17)},
+		{"window end", at(1, 17), rate.Inf, rate.Inf, at(2, 9)},
+		{"other weekday", at(3, 12), rate.Inf, rate.Inf, at(5, 22)},
+		{"wrapping window", at(5, 23), 2048, 200, at(6, 2)},
+		{"past midnight", at(6, 1), 2048, 200, at(6, 2)},
+		{"next week", at(6, 3), rate.Inf, rate.Inf, at(8, 9)},
+	} {
+		global, local := s.limitsAt(test.t)
+		if global != test.expectedGlobal || local != test.expectedLocal {
+			t.Errorf("%s: expected limits %v/%v, got %v/%v", test.name,
+				test.expectedGlobal, test.expectedLocal, global, local)
+		}
+		if next := s.next(test.t); !next.Equal(test.expectedNext) {
+			t.Errorf("%s: expected next boundary %s, got %s", test.name,
+				test.expectedNext, next)
+		}
+	}
+}
+
+func TestScheduleOmittedLimits(t *testing.T) {
+	s := Schedule{
+		Rules: []ScheduleRule{
+			{GlobalLimit: rate.Limit(1024)},
+		},
+	}
+
+	// The limits left out mean no limits, rather than stopping the traffic.
+	if global, local := s.limitsAt(time.Now()); global != 1024 || local != rate.Inf {
+		t.Errorf("expected limits %v/%v, got %v/%v", rate.Limit(1024), rate.Inf, global, local)
+	}
+
+	s.Rules = nil
+	if global, local := s.limitsAt(time.Now()); global != rate.Inf || local != rate.Inf {
+		t.Errorf("expected limits %v/%v, got %v/%v", rate.Inf, rate.Inf, global, local)
+	}
+}
+
+func TestScheduleValidation(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		schedule Schedule
+		expected bool
+	}{
+		{"empty", Schedule{}, true},
+		{"negative limit", Schedule{GlobalLimit: -1}, false},
+		{"negative rule limit", Schedule{Rules: []ScheduleRule{{LocalLimit: -1}}}, false},
+		{"start past day", Schedule{Rules: []ScheduleRule{{Start: day}}}, false},
+		{"end past day", Schedule{Rules: []ScheduleRule{{End: day + 1}}}, false},
+		{"whole day", Schedule{Rules: []ScheduleRule{{End: day}}}, true},
+	} {
+		if got := test.schedule.valid(); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+
+		// The invalid Schedule is ignored by the option.
+		l := NewLimiter(WithSchedule(&test.schedule))
+		if got := l.schedule != nil; got != test.expected {
+			t.Errorf("%s: expected the Schedule to be used: %v, got %v", test.name, test.expected, got)
+		}
+		l.SetSchedule(nil)
+	}
+}
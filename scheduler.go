@@ -0,0 +1,220 @@
+package tcplimit
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// errBurstExceeded means that the request does not fit in the burst
+// anymore (the burst has been changed meanwhile), and should be retried
+// with a smaller chunk.
+var errBurstExceeded = errors.New("burst exceeded")
+
+// flow is a stream of requests of a single connection's direction,
+// scheduled by the scheduler. The flow's fields are guarded by
+// the scheduler's mutex.
+type flow struct {
+	// finish is the virtual finish time of the flow's last request.
+	finish float64
+	// weight is the flow's share of the limit, relative to the other flows
+	// of the same priority.
+	weight float64
+	// priority is the flow's strict priority class. Flows of lower
+	// priority get only what the higher ones leave unused.
+	priority int
+}
+
+func newFlow() *flow {
+	return &flow{weight: 1}
+}
+
+type request struct {
+	flow  *flow
+	start float64
+	index int
+}
+
+// scheduler hands out the limiter's tokens to the flows in a max-min fair
+// manner, using start-time fair queueing. Every request is tagged with
+// a virtual start time, being the later of the current virtual time and
+// the virtual finish time of the flow's previous request, and requests are
+// served in the order of their tags. This way, backlogged flows get equal
+// shares of the limit, while the bandwidth left unused by the other flows
+// is shared among them (the scheduler is work-conserving).
+//
+// Flows advance their virtual time inversely proportionally to their
+// weights, which makes the shares weighted. On top of that, the flows are
+// divided into strict priority classes, each having its own virtual time.
+// Requests of a higher class are always served first.
+//
+// Unlike with the plain limiter, the tokens are taken only when they are
+// available, so that a request arriving later with a lower tag can still
+// be served before the ones waiting in the queue.
+type scheduler struct {
+	lim   *rate.Limiter
+	clock Clock
+	mu    sync.Mutex
+	queue requestQueue
+	// vtime is the virtual time of every priority class, which is
+	// the start tag of the class' last request served.
+	vtime   map[int]float64
+	changed chan struct{}
+}
+
+// acquire waits in the queue for its turn, then takes n tokens from
+// the limiter. The cost, by which the flow's virtual time advances,
+// may differ from n, e.g. when the tokens are charged afterwards.
+//
+// The wait function is expected to block for the duration d (or
+// indefinitely, when d is negative), until the wake channel is closed,
+// or until the wait is interrupted, in which case it returns an error.
+func (s *scheduler) acquire(f *flow, n, cost int,
+	wait func(d time.Duration, wake <-chan struct{}) error) error {
+	s.mu.Lock()
+
+	r := &request{flow: f, start: max(s.vtime[f.priority], f.finish)}
+	f.finish = r.start + float64(cost)/f.weight
+	heap.Push(&s.queue, r)
+	s.notify()
+
+	for {
+		d := time.Duration(-1)
+		if s.queue[0] == r {
+			var err error
+			if d, err = s.delay(n); err != nil || d == 0 {
+				heap.Remove(&s.queue, r.index)
+				if err == nil {
+					s.vtime[f.priority] = r.start
+					s.lim.ReserveN(s.clock.Now(), n)
+				} else {
+					f.finish -= float64(cost) / f.weight
+				}
+				s.notify()
+				s.mu.Unlock()
+				return err
+			}
+		}
+
+		wake := s.changed
+		s.mu.Unlock()
+
+		err := wait(d, wake)
+
+		s.mu.Lock()
+		if err != nil {
+			heap.Remove(&s.queue, r.index)
+			f.finish -= float64(cost) / f.weight
+			s.notify()
+			s.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// delay returns how long it takes for n tokens to become available.
+// The mutex is expected to be held.
+func (s *scheduler) delay(n int) (time.Duration, error) {
+	limit := s.lim.Limit()
+	switch {
+	case limit == rate.Inf:
+		return 0, nil
+	case limit == 0:
+		return 0, ErrUnfulfillableReservation
+	case n > s.lim.Burst():
+		return 0, errBurstExceeded
+	}
+
+	tokens := s.lim.TokensAt(s.clock.Now())
+	if missing := float64(n) - tokens; missing > 0 {
+		return max(time.Duration(missing/float64(limit)*float64(time.Second)), 1), nil
+	}
+	return 0, nil
+}
+
+// charge charges the limiter with n tokens, advancing the flow's virtual
+// time by cost. Both may be negative, to give back what was not used.
+func (s *scheduler) charge(f *flow, t time.Time, n, cost int) {
+	s.mu.Lock()
+	chargeN(s.lim, t, n)
+	f.finish += float64(cost) / f.weight
+	s.mu.Unlock()
+}
+
+// setClass sets the flow's weight and priority class. When the class
+// changes, the flow starts over at the new class' virtual time.
+func (s *scheduler) setClass(f *flow, weight float64, priority int) {
+	s.mu.Lock()
+	if f.priority != priority {
+		f.finish = s.vtime[priority]
+	}
+	f.weight = weight
+	f.priority = priority
+
+	// The flow's requests may be queued already.
+	heap.Init(&s.queue)
+	s.notify()
+	s.mu.Unlock()
+}
+
+// wake wakes up the waiting requests, e.g. when the limit changes.
+func (s *scheduler) wake() {
+	s.mu.Lock()
+	s.notify()
+	s.mu.Unlock()
+}
+
+// notify closes the changed channel. The mutex is expected to be held.
+func (s *scheduler) notify() {
+	if s.changed != nil {
+		close(s.changed)
+	}
+	s.changed = make(chan struct{})
+}
+
+func newScheduler(lim *rate.Limiter, clock Clock) *scheduler {
+	return &scheduler{
+		lim:     lim,
+		clock:   clock,
+		vtime:   make(map[int]float64),
+		changed: make(chan struct{}),
+	}
+}
+
+// requestQueue is a heap of requests ordered by their flows' priorities,
+// then by their start tags.
+type requestQueue []*request
+
+func (q requestQueue) Len() int {
+	return len(q)
+}
+
+func (q requestQueue) Less(i, j int) bool {
+	if pi, pj := q[i].flow.priority, q[j].flow.priority; pi != pj {
+		return pi > pj
+	}
+	return q[i].start < q[j].start
+}
+
+func (q requestQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *requestQueue) Push(x any) {
+	r := x.(*request)
+	r.index = len(*q)
+	*q = append(*q, r)
+}
+
+func (q *requestQueue) Pop() any {
+	old := *q
+	r := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return r
+}
@@ -0,0 +1,136 @@
+package tcplimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func waitForQueueLen(s *scheduler, n int) {
+	for {
+		s.mu.Lock()
+		l := s.queue.Len()
+		s.mu.Unlock()
+		if l == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	s := newScheduler(rate.NewLimiter(rate.Limit(1024), 1024), defaultClock)
+	s.lim.ReserveN(time.Now(), 1024) // Drain the bucket.
+
+	wait := func(d time.Duration, wake <-chan struct{}) error {
+		if d < 0 {
+			<-wake
+			return nil
+		}
+
+		select {
+		case <-time.After(d):
+		case <-wake:
+		}
+		return nil
+	}
+
+	// The greedy flow has already used much more than the other one,
+	// so the latter should be served first, despite arriving later.
+	greedy := newFlow()
+	greedy.finish = 1024
+	other := newFlow()
+
+	served := make(chan *flow, 2)
+	go func() {
+		s.acquire(greedy, 10, 10, wait)
+		served <- greedy
+	}()
+	waitForQueueLen(s, 1)
+	go func() {
+		s.acquire(other, 10, 10, wait)
+		served <- other
+	}()
+
+	if f := <-served; f != other {
+		t.Error("expected the other flow to be served first")
+	}
+	if f := <-served; f != greedy {
+		t.Error("expected the greedy flow to be served second")
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := newScheduler(rate.NewLimiter(rate.Limit(1024), 1024), defaultClock)
+	s.lim.ReserveN(time.Now(), 1024) // Drain the bucket.
+
+	wait := func(d time.Duration, wake <-chan struct{}) error {
+		if d < 0 {
+			<-wake
+			return nil
+		}
+
+		select {
+		case <-time.After(d):
+		case <-wake:
+		}
+		return nil
+	}
+
+	bulk := newFlow()
+	interactive := newFlow()
+	s.setClass(interactive, 1, 1)
+
+	served := make(chan *flow, 2)
+	go func() {
+		s.acquire(bulk, 10, 10, wait)
+		served <- bulk
+	}()
+	waitForQueueLen(s, 1)
+	go func() {
+		s.acquire(interactive, 10, 10, wait)
+		served <- interactive
+	}()
+
+	if f := <-served; f != interactive {
+		t.Error("expected the interactive flow to be served first")
+	}
+	if f := <-served; f != bulk {
+		t.Error("expected the bulk flow to be served second")
+	}
+}
+
+func TestSchedulerInterruption(t *testing.T) {
+	s := newScheduler(rate.NewLimiter(rate.Limit(1), 1024), defaultClock)
+	s.lim.ReserveN(time.Now(), 1024) // Drain the bucket.
+
+	expected := errors.New("interrupted")
+	f := newFlow()
+
+	err := s.acquire(f, 1024, 1024, func(time.Duration, <-chan struct{}) error {
+		return expected
+	})
+	if !errors.Is(err, expected) {
+		t.Errorf("expected %s, got %s", expected, err)
+	}
+
+	if s.queue.Len() != 0 {
+		t.Errorf("expected the queue to be empty, got %d requests", s.queue.Len())
+	}
+	if f.finish != 0 {
+		t.Errorf("expected the flow's finish tag to be reverted, got %f", f.finish)
+	}
+}
+
+func TestSchedulerZeroLimit(t *testing.T) {
+	s := newScheduler(rate.NewLimiter(rate.Limit(0), 1024), defaultClock)
+
+	err := s.acquire(newFlow(), 1024, 1024, func(time.Duration, <-chan struct{}) error {
+		return nil
+	})
+	if !errors.Is(err, ErrUnfulfillableReservation) {
+		t.Errorf("expected %s, got %s", ErrUnfulfillableReservation, err)
+	}
+}
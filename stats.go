@@ -0,0 +1,82 @@
+package tcplimit
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats holds the traffic statistics of a connection.
+type ConnStats struct {
+	// BytesRead is the number of bytes read from the connection.
+	BytesRead int64
+	// BytesWritten is the number of bytes written to the connection.
+	BytesWritten int64
+	// Throttled is the number of operations, which had to wait
+	// for the bandwidth.
+	Throttled int64
+	// Throttling is the total time spent waiting for the bandwidth.
+	Throttling time.Duration
+	// Dropped is the number of datagrams dropped over the limit
+	// (see WithPacketDrop).
+	Dropped int64
+	// Created is the time when the connection was wrapped.
+	Created time.Time
+}
+
+// LimiterStats holds the aggregate traffic statistics of all
+// the connections ever wrapped by a Limiter, including the ones
+// already closed.
+type LimiterStats struct {
+	// BytesRead is the number of bytes read from the connections.
+	BytesRead int64
+	// BytesWritten is the number of bytes written to the connections.
+	BytesWritten int64
+	// Throttled is the number of operations, which had to wait
+	// for the bandwidth.
+	Throttled int64
+	// Throttling is the total time spent waiting for the bandwidth.
+	Throttling time.Duration
+	// Dropped is the number of datagrams dropped over the limit
+	// (see WithPacketDrop).
+	Dropped int64
+	// ActiveConns is the number of connections, which are not closed yet.
+	ActiveConns int
+	// TotalConns is the number of connections ever wrapped.
+	TotalConns int64
+}
+
+// counters are the traffic counters, propagating their updates
+// to the parent counters (if any).
+type counters struct {
+	parent       *counters
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	throttled    atomic.Int64
+	throttling   atomic.Int64
+	dropped      atomic.Int64
+}
+
+func (c *counters) addRead(n int) {
+	for ; c != nil; c = c.parent {
+		c.bytesRead.Add(int64(n))
+	}
+}
+
+func (c *counters) addWritten(n int) {
+	for ; c != nil; c = c.parent {
+		c.bytesWritten.Add(int64(n))
+	}
+}
+
+func (c *counters) addThrottling(d time.Duration) {
+	for ; c != nil; c = c.parent {
+		c.throttled.Add(1)
+		c.throttling.Add(int64(d))
+	}
+}
+
+func (c *counters) addDropped() {
+	for ; c != nil; c = c.parent {
+		c.dropped.Add(1)
+	}
+}
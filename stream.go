@@ -0,0 +1,88 @@
+package tcplimit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	// errNotReadable is returned by Read of a wrapped io.Writer.
+	errNotReadable = errors.New("read from a write-only stream")
+	// errNotWritable is returned by Write of a wrapped io.Reader.
+	errNotWritable = errors.New("write to a read-only stream")
+)
+
+// streamAdapter lets a stream (any of its reader, writer and closer being
+// optional) be wrapped like a connection.
+type streamAdapter struct {
+	r      io.Reader
+	w      io.Writer
+	c      io.Closer
+	remote net.Addr
+}
+
+func (a *streamAdapter) Read(p []byte) (int, error) {
+	if a.r == nil {
+		return 0, errNotReadable
+	}
+	return a.r.Read(p)
+}
+
+func (a *streamAdapter) Write(p []byte) (int, error) {
+	if a.w == nil {
+		return 0, errNotWritable
+	}
+	return a.w.Write(p)
+}
+
+func (a *streamAdapter) Close() error {
+	if a.c == nil {
+		return nil
+	}
+	return a.c.Close()
+}
+
+func (a *streamAdapter) LocalAddr() net.Addr {
+	return nil
+}
+
+func (a *streamAdapter) RemoteAddr() net.Addr {
+	return a.remote
+}
+
+// SetDeadline does nothing, but the deadlines still apply to the waits
+// for the bandwidth.
+func (a *streamAdapter) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (a *streamAdapter) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (a *streamAdapter) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// LimitReader wraps the reader into a bandwidth-limited Conn, charged
+// against the same limits as the connections, e.g. to shape file copies
+// or multiplexed streams. The Conn's writes fail. Closing the Conn
+// releases it from the Limiter, leaving the reader intact.
+func (l *Limiter) LimitReader(r io.Reader) Conn {
+	return l.LimitConn(&streamAdapter{r: r})
+}
+
+// LimitWriter wraps the writer into a bandwidth-limited Conn. The Conn's
+// reads fail. See LimitReader for more information.
+func (l *Limiter) LimitWriter(w io.Writer) Conn {
+	return l.LimitConn(&streamAdapter{w: w})
+}
+
+// LimitReadWriteCloser wraps the stream into a bandwidth-limited Conn,
+// which closes the stream when closed. See LimitReader for more
+// information.
+func (l *Limiter) LimitReadWriteCloser(rwc io.ReadWriteCloser) Conn {
+	return l.LimitConn(&streamAdapter{r: rwc, w: rwc, c: rwc})
+}
@@ -0,0 +1,85 @@
+package tcplimit_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ksinica/tcplimit"
+	"github.com/ksinica/tcplimit/internal/pkg/mock"
+	"golang.org/x/time/rate"
+)
+
+func TestLimiterLimitWriter(t *testing.T) {
+	var slept time.Duration
+	now := time.Now()
+	limiter := tcplimit.NewLimiter(
+		tcplimit.WithClock(&mock.Clock{
+			OnNow: func() time.Time {
+				return now
+			},
+			OnSleep: func(d time.Duration) {
+				slept += d
+				now = now.Add(d)
+			},
+		}),
+	)
+
+	var buf bytes.Buffer
+	w := limiter.LimitWriter(&buf)
+	defer w.Close()
+
+	// The local limit applies to the writers wrapped already.
+	if err := limiter.SetLocalLimit(rate.Limit(1024)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := io.Copy(w, bytes.NewReader(make([]byte, 2048))); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if buf.Len() != 2048 {
+		t.Errorf("expected %d bytes written, got %d", 2048, buf.Len())
+	}
+	if slept != time.Second {
+		t.Errorf("expected write to be throttled for %s, got %s", time.Second, slept)
+	}
+	if _, err := w.Read(make([]byte, 1)); err == nil {
+		t.Error("expected read from a writer to fail")
+	}
+}
+
+func TestLimiterLimitReader(t *testing.T) {
+	limiter := tcplimit.NewLimiter()
+
+	r := limiter.LimitReader(bytes.NewReader(make([]byte, 2048)))
+	if stats := limiter.Stats(); stats.ActiveConns != 1 {
+		t.Errorf("expected the reader to be tracked, got %d active connections", stats.ActiveConns)
+	}
+
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if n != 2048 || r.Stats().BytesRead != 2048 {
+		t.Errorf("expected %d bytes read, got %d (%d)", 2048, n, r.Stats().BytesRead)
+	}
+
+	r.Close()
+	if stats := limiter.Stats(); stats.ActiveConns != 0 {
+		t.Errorf("expected the reader to be released, got %d active connections", stats.ActiveConns)
+	}
+}
+
+func TestLimiterLimitReadWriteCloser(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	rwc := tcplimit.NewLimiter().LimitReadWriteCloser(local)
+	rwc.Close()
+
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the stream to be closed, got %v", err)
+	}
+}